@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// archAll is the directory architecture independent packages are kept
+// in under -arch.
+const archAll = "all"
+
+// archDir returns the directory packages are built into. Under -arch
+// each architecture has its own directory in debDir.
+func archDir(debDir string) string {
+	if arch == "" {
+		return debDir
+	}
+	return filepath.Join(debDir, arch)
+}
+
+// packageDirs returns the directories holding the packages available
+// to a build: those of the -arch architecture and the architecture
+// independent ones.
+func packageDirs(debDir string) []string {
+	if arch == "" {
+		return []string{debDir}
+	}
+	return []string{archDir(debDir), filepath.Join(debDir, archAll)}
+}
+
+// globPackages matches a file name pattern in each of the package
+// directories.
+func globPackages(debDir, pattern string) []string {
+	var out []string
+	for _, dir := range packageDirs(debDir) {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		out = append(out, matches...)
+	}
+	return out
+}
+
+// separateArchAll moves the architecture independent packages with
+// the given artifact prefixes, those of the build that wrote them,
+// from the -arch directory into the directory shared by all
+// architectures. Builds run at the same time only move their own
+// packages so they can't move one another's half written ones.
+func separateArchAll(debDir string, prefixes map[string]bool) error {
+	if arch == "" {
+		return nil
+	}
+	all := filepath.Join(debDir, archAll)
+	err := os.MkdirAll(all, 0777)
+	if err != nil {
+		return err
+	}
+	for _, pattern := range []string{"*_all.deb", "*_all.udeb"} {
+		debs, err := filepath.Glob(filepath.Join(archDir(debDir), pattern))
+		if err != nil {
+			return err
+		}
+		for _, deb := range debs {
+			if !isArtifact(filepath.Base(deb), prefixes) {
+				continue
+			}
+			err := os.Rename(deb, filepath.Join(all, filepath.Base(deb)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// repoPrefixes returns the artifact prefixes of the repo in repoPath,
+// salvaging them from a control file that can't be parsed.
+func repoPrefixes(repoPath string) map[string]bool {
+	prefixes, err := artifactPrefixes(repoPath)
+	if err == nil {
+		return prefixes
+	}
+	prefixes = make(map[string]bool)
+	for _, name := range salvagePackages(
+		filepath.Join(repoPath, "debian", "control")) {
+		prefixes[name] = true
+	}
+	return prefixes
+}
+
+// linkPackages gathers the packages in dirs into a single directory,
+// as a build can only be given one, hard linking them where possible.
+func linkPackages(into string, dirs ...string) error {
+	err := os.RemoveAll(into)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(into, 0777)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		for _, pattern := range []string{"*.deb", "*.udeb"} {
+			debs, err := filepath.Glob(filepath.Join(dir, pattern))
+			if err != nil {
+				return err
+			}
+			for _, deb := range debs {
+				to := filepath.Join(into, filepath.Base(deb))
+				if os.Link(deb, to) == nil {
+					continue
+				}
+				err := copyFile(deb, to)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
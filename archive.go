@@ -0,0 +1,106 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archiveManifest is the index written at the root of a log archive.
+const archiveManifest = "MANIFEST"
+
+// archiveLogs bundles the files in logDir, which include the build
+// report, into a gzipped tarball at path. A MANIFEST listing the size
+// of each file is written first.
+func archiveLogs(path, logDir string) error {
+	abs := resolvePath(path)
+	var files []string
+	err := filepath.Walk(logDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || resolvePath(p) == abs {
+			return nil
+		}
+		files = append(files, p)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var manifest strings.Builder
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(logDir, file)
+		fmt.Fprintf(&manifest, "%d\t%s\n", info.Size(), rel)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	err = tw.WriteHeader(&tar.Header{
+		Name:    archiveManifest,
+		Mode:    0644,
+		Size:    int64(manifest.Len()),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(tw, manifest.String())
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		err := archiveFile(tw, logDir, file)
+		if err != nil {
+			return err
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func archiveFile(tw *tar.Writer, base, file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name, _ = filepath.Rel(base, file)
+	hdr.Name = filepath.ToSlash(hdr.Name)
+	err = tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, in, hdr.Size)
+	return err
+}
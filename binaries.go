@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// binarySelection is the binary packages -binaries keeps from a repo's
+// build out of all those it declares. The builders can't build single
+// packages of a source package, so the others are built and then
+// dropped, but sbuild skips the architecture independent or dependent
+// packages when none of them are wanted.
+type binarySelection struct {
+	declared map[string]bool
+	wanted   map[string]bool
+	// indep and dep are whether Architecture: all, and other,
+	// packages are wanted
+	indep, dep bool
+}
+
+// selectBinaries returns the -binaries selection for the repo in
+// repoPath, nil when all its packages are kept. Requesting a package
+// the repo doesn't declare is an error, it would silently drop all
+// of them.
+func selectBinaries(repo, repoPath string) (*binarySelection, error) {
+	list, ok := binaryFilter[repo]
+	if !ok {
+		return nil, nil
+	}
+	ctrl, err := readRepoControl(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	sel := &binarySelection{
+		declared: make(map[string]bool),
+		wanted:   make(map[string]bool),
+	}
+	for _, bin := range ctrl.Binaries {
+		sel.declared[strings.TrimSpace(bin.Package)] = true
+	}
+	var unknown []string
+	for _, pkg := range strings.Split(list, ",") {
+		pkg = strings.TrimSpace(pkg)
+		if !sel.declared[pkg] {
+			unknown = append(unknown, pkg)
+		}
+		sel.wanted[pkg] = true
+	}
+	for _, bin := range ctrl.Binaries {
+		if !sel.wanted[strings.TrimSpace(bin.Package)] {
+			continue
+		}
+		if a, _ := fieldValue(bin.Paragraph, "Architecture"); a == "all" {
+			sel.indep = true
+		} else {
+			sel.dep = true
+		}
+	}
+	if len(unknown) != 0 {
+		return nil, fmt.Errorf("requested binary packages not "+
+			"declared by %s: %s", repo, strings.Join(unknown, ", "))
+	}
+	return sel, nil
+}
+
+// sbuildArgs returns the sbuild options that leave out the
+// architecture independent or dependent half of the build when none
+// of its packages are selected.
+func (s *binarySelection) sbuildArgs() []string {
+	switch {
+	case s == nil:
+		return nil
+	case !s.dep:
+		return []string{"--arch-all", "--no-arch-any"}
+	case !s.indep:
+		return []string{"--no-arch-all"}
+	}
+	return nil
+}
+
+// drop removes the packages of the repo that weren't selected from
+// destDir.
+func (s *binarySelection) drop(destDir string) error {
+	if s == nil {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(destDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if ext != ".deb" && ext != ".udeb" {
+			continue
+		}
+		pkg := strings.SplitN(name, "_", 2)[0]
+		if !s.declared[pkg] || s.wanted[pkg] {
+			continue
+		}
+		fmt.Println("Dropping unselected package", name)
+		err := os.Remove(filepath.Join(destDir, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
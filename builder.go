@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	bpkg "jsouthworth.net/go/danos-buildpackage"
+)
+
+// packageBuilder builds the Debian package in a source directory.
+type packageBuilder interface {
+	Build() error
+	Close() error
+}
+
+// buildConfig describes a single package build independent of the
+// backend that performs it.
+type buildConfig struct {
+	// ctx cancels the build
+	ctx       context.Context
+	srcDir    string
+	destDir   string
+	pkgDir    string
+	imageName string
+	version   string
+	local     bool
+	// arch is the architecture to build for, empty for the host's
+	arch string
+	// cpus and memory limit the build, 0 is unlimited
+	cpus   float64
+	memory int64
+	// offline builds have no network access
+	offline bool
+	// ccacheDir is the compiler cache mounted into the build, if any
+	ccacheDir string
+	// debBuildOpts are extra dpkg-buildpackage options
+	debBuildOpts []string
+	// binaries is the -binaries selection, nil for all packages
+	binaries *binarySelection
+}
+
+var builders = map[string]func(buildConfig) (packageBuilder, error){
+	"docker": makeDockerBuilder,
+	"sbuild": makeSbuildBuilder,
+}
+
+func makeBuilder(name string, cfg buildConfig) (packageBuilder, error) {
+	mk, ok := builders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown builder %q", name)
+	}
+	return mk(cfg)
+}
+
+// dockerBuilder builds packages with danos-buildpackage.
+type dockerBuilder struct {
+	*bpkg.Builder
+	cfg  buildConfig
+	cli  *client.Client
+	hook *containerHook
+}
+
+func makeDockerBuilder(cfg buildConfig) (packageBuilder, error) {
+	hook := new(containerHook)
+	if cfg.cpus != 0 || cfg.memory != 0 || cfg.offline ||
+		cfg.ccacheDir != "" {
+		hook.adjust = func(c *container.Config, hc *container.HostConfig) {
+			limitContainer(cfg, hc)
+			mountCcache(cfg, c, hc)
+		}
+	}
+	cli, err := newHookedClient(hook)
+	if err != nil {
+		return nil, err
+	}
+	opts := []bpkg.MakeBuilderOption{
+		bpkg.WithClient(cli),
+		bpkg.WithContext(cfg.ctx),
+		bpkg.SourceDirectory(cfg.srcDir),
+		bpkg.DestinationDirectory(cfg.destDir),
+		bpkg.PreferredPackageDirectory(cfg.pkgDir),
+		bpkg.ImageName(cfg.imageName),
+		bpkg.Version(cfg.version),
+	}
+	if cfg.local {
+		opts = append(opts, bpkg.LocalImage())
+	}
+	bpkgBldr, err := bpkg.MakeBuilder(opts...)
+	if err != nil {
+		cli.Close()
+		return nil, err
+	}
+	return &dockerBuilder{Builder: bpkgBldr, cfg: cfg, cli: cli,
+		hook: hook}, nil
+}
+
+func (b *dockerBuilder) Build() error {
+	err := b.Builder.Build()
+	if b.cfg.ctx.Err() != nil {
+		stopContainer(b.cli, b.hook)
+	}
+	if err != nil && b.hook.killedForMemory() {
+		return fmt.Errorf("%s: %s", errOOMKilled, err)
+	}
+	return err
+}
+
+// ccacheMount is where -ccache-dir is mounted in build containers.
+const ccacheMount = "/ccache"
+
+// mountCcache binds the build's compiler cache into its container and
+// points ccache at it.
+func mountCcache(cfg buildConfig, c *container.Config, hc *container.HostConfig) {
+	if cfg.ccacheDir == "" {
+		return
+	}
+	hc.Binds = append(hc.Binds, cfg.ccacheDir+":"+ccacheMount)
+	c.Env = append(c.Env, "CCACHE_DIR="+ccacheMount)
+}
+
+// sbuildBuilder builds packages in an sbuild chroot for hosts that
+// can't run docker.
+type sbuildBuilder struct {
+	cfg buildConfig
+}
+
+func makeSbuildBuilder(cfg buildConfig) (packageBuilder, error) {
+	if _, err := exec.LookPath("sbuild"); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(cfg.srcDir + "/debian/control"); err != nil {
+		return nil, fmt.Errorf(
+			"must be run from the top level of a debian package tree")
+	}
+	return &sbuildBuilder{cfg: cfg}, nil
+}
+
+func (b *sbuildBuilder) args() []string {
+	args := []string{
+		"--dist=" + sbuildDist,
+		"--build-dir=" + b.cfg.destDir,
+		"--nolog",
+	}
+	if b.cfg.arch != "" {
+		args = append(args, "--arch="+b.cfg.arch)
+	}
+	if b.cfg.pkgDir != "" {
+		args = append(args, "--extra-package="+b.cfg.pkgDir)
+	}
+	args = append(args, b.cfg.binaries.sbuildArgs()...)
+	for _, opt := range b.cfg.debBuildOpts {
+		args = append(args, "--debbuildopt="+opt)
+	}
+	return append(args, b.cfg.srcDir)
+}
+
+func (b *sbuildBuilder) Build() error {
+	// unlike a docker bind mount, sbuild needs the directory
+	err := os.MkdirAll(b.cfg.destDir, 0777)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("sbuild", b.args()...)
+	cmd.Dir = b.cfg.srcDir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = buildProcAttr()
+	err = runTerminating(b.cfg.ctx, cmd)
+	if err != nil {
+		return fmt.Errorf("Build failed: %s", err)
+	}
+	return nil
+}
+
+func (b *sbuildBuilder) Close() error {
+	return nil
+}
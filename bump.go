@@ -0,0 +1,65 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"pault.ag/go/debian/dependency"
+	debversion "pault.ag/go/debian/version"
+)
+
+// packageVersions returns the version of each package in debDir.
+func packageVersions(debDir string) map[string]string {
+	out := make(map[string]string)
+	debs := globPackages(debDir, "*.deb")
+	for _, deb := range debs {
+		name := strings.SplitN(filepath.Base(deb), "_", 2)[0]
+		out[name] = debVersion(deb)
+	}
+	return out
+}
+
+// bumpedDependents returns the repos, other than those already built,
+// with a versioned build dependency on a package whose version changed
+// between before and after, where that changes the version satisfying
+// the dependency. Their build was made against a version of the
+// package they no longer build with.
+func bumpedDependents(repos repoMetaData, built map[string]bool, before, after map[string]string) map[string]bool {
+	out := make(map[string]bool)
+	for repo, ctrl := range repos.ctrlFiles {
+		if built[repo] {
+			continue
+		}
+		for _, rel := range ctrl.Source.BuildDepends.Relations {
+			for _, pos := range rel.Possibilities {
+				if pos.Version == nil {
+					continue
+				}
+				name := packageName(pos.Name)
+				old, ok := before[name]
+				if !ok || after[name] == old {
+					continue
+				}
+				if satisfying(*pos.Version, old) !=
+					satisfying(*pos.Version, after[name]) {
+					out[repo] = true
+				}
+			}
+		}
+	}
+	return out
+}
+
+// satisfying returns the package version if it satisfies a versioned
+// dependency, and "" if it doesn't. A version that can't be parsed, or
+// a package that is no longer built, satisfies nothing.
+func satisfying(rel dependency.VersionRelation, ver string) string {
+	if ver == "" {
+		return ""
+	}
+	v, err := debversion.Parse(ver)
+	if err != nil || !rel.SatisfiedBy(v) {
+		return ""
+	}
+	return ver
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBumpedDependents(t *testing.T) {
+	repos := testRepos(t, map[string]string{
+		"foo": "Source: foo\n\nPackage: foo\nArchitecture: any\n",
+		"bar": "Source: bar\nBuild-Depends: foo (>= 1.0)\n\n" +
+			"Package: bar\nArchitecture: any\n",
+		"baz": "Source: baz\nBuild-Depends: foo\n\n" +
+			"Package: baz\nArchitecture: any\n",
+		"qux": "Source: qux\nBuild-Depends: foo (>= 2.0)\n\n" +
+			"Package: qux\nArchitecture: any\n",
+	})
+	built := map[string]bool{"foo": true}
+
+	for _, test := range []struct {
+		name          string
+		before, after string
+		want          map[string]bool
+	}{
+		// still satisfied, but by the new version
+		{"1.1 to 1.2", "1.1", "1.2", map[string]bool{"bar": true}},
+		{"1.2 to 2.0", "1.2", "2.0",
+			map[string]bool{"bar": true, "qux": true}},
+		// satisfies neither relation before or after
+		{"0.8 to 0.9", "0.8", "0.9", map[string]bool{}},
+		{"unchanged", "1.1", "1.1", map[string]bool{}},
+	} {
+		got := bumpedDependents(repos, built,
+			map[string]string{"foo": test.before},
+			map[string]string{"foo": test.after})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got,
+				test.want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"pault.ag/go/debian/control"
+)
+
+// casKey identifies the build of the repo in repoPath by its commit
+// and the build environment, so identical builds can share artifacts
+// in -cas-dir. Repos that aren't clean git checkouts have no key.
+func casKey(repo, repoPath string) (string, bool) {
+	commit, err := repoCommit(repoPath)
+	if err != nil {
+		return "", false
+	}
+	cmd := exec.Command("git", "status", "--porcelain")
+	cmd.Dir = repoPath
+	status, err := cmd.Output()
+	if err != nil || len(status) != 0 {
+		return "", false
+	}
+	h := sha256.New()
+	fmt.Fprintln(h, commit)
+	fmt.Fprintln(h, version)
+	fmt.Fprintln(h, builderName, imageName, local, sbuildDist, arch)
+	// -buildpackage-opts can change what is built
+	fmt.Fprintln(h, strings.Join(strings.Fields(debBuildOpts[repo]), " "))
+	// as can -binaries, when sbuild skips half the packages
+	if builderName == "sbuild" {
+		sel, err := selectBinaries(repo, repoPath)
+		if err != nil {
+			return "", false
+		}
+		if args := sel.sbuildArgs(); len(args) != 0 {
+			fmt.Fprintln(h, strings.Join(args, " "))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// readRepoControl parses the control file of the repo in repoPath.
+func readRepoControl(repoPath string) (*control.Control, error) {
+	path := filepath.Join(repoPath, "debian", "control")
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return control.ParseControl(bufio.NewReader(f), path)
+}
+
+// artifactPrefixes returns the names a repo's build artifacts start
+// with: its source and binary package names.
+func artifactPrefixes(repoPath string) (map[string]bool, error) {
+	ctrl, err := readRepoControl(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]bool{strings.TrimSpace(ctrl.Source.Source): true}
+	for _, bin := range ctrl.Binaries {
+		out[strings.TrimSpace(bin.Package)] = true
+	}
+	return out, nil
+}
+
+// isArtifact reports whether a file in debDir was built from a repo
+// with the given artifact prefixes.
+func isArtifact(name string, prefixes map[string]bool) bool {
+	return prefixes[strings.SplitN(name, "_", 2)[0]]
+}
+
+// unlinkArtifacts removes the links to cached artifacts of a repo from
+// the package directories so that rebuilding it doesn't write through
+// them into the cache. Symlinks are left by runs from before cached
+// artifacts were hard linked.
+func unlinkArtifacts(debDir string, prefixes map[string]bool) error {
+	for _, dir := range packageDirs(debDir) {
+		entries, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !isArtifact(entry.Name(), prefixes) ||
+				(entry.Mode()&os.ModeSymlink == 0 &&
+					!hardLinked(entry)) {
+				continue
+			}
+			err := os.Remove(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dirState records the size and modification time of the files in a
+// directory so the files a build wrote can be found.
+func dirState(dir string) map[string]os.FileInfo {
+	out := make(map[string]os.FileInfo)
+	entries, _ := ioutil.ReadDir(dir)
+	for _, entry := range entries {
+		out[entry.Name()] = entry
+	}
+	return out
+}
+
+// changedArtifacts returns the artifacts of a repo in debDir that are
+// new or modified since before.
+func changedArtifacts(debDir string, before map[string]os.FileInfo, prefixes map[string]bool) []string {
+	var out []string
+	for name, info := range dirState(debDir) {
+		if !info.Mode().IsRegular() || !isArtifact(name, prefixes) {
+			continue
+		}
+		prev, ok := before[name]
+		if ok && prev.Size() == info.Size() &&
+			prev.ModTime().Equal(info.ModTime()) {
+			continue
+		}
+		out = append(out, name)
+	}
+	return out
+}
+
+// hardLinked reports whether a file has other links to it.
+func hardLinked(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Nlink > 1
+}
+
+// linkOrCopy hard links from to to, copying it when they are on
+// different filesystems. Symlinks can't be used as debDir is bind
+// mounted into the builds where the cache's paths don't resolve.
+func linkOrCopy(from, to string) error {
+	err := os.Link(from, to)
+	if err == nil {
+		return nil
+	}
+	return copyFile(from, to)
+}
+
+// casFetch links the cached artifacts in entry into debDir, it
+// reports whether there was a cache entry.
+func casFetch(entry, debDir string) (bool, error) {
+	files, err := ioutil.ReadDir(entry)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = os.MkdirAll(debDir, 0777)
+	if err != nil {
+		return false, err
+	}
+	for _, file := range files {
+		link := filepath.Join(debDir, file.Name())
+		err := os.Remove(link)
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		err = linkOrCopy(filepath.Join(entry, file.Name()), link)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// casStore copies the named artifacts from debDir into the cache
+// entry. The entry only appears once it is complete.
+func casStore(entry, debDir string, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	tmp := entry + ".tmp"
+	err := os.RemoveAll(tmp)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(tmp, 0777)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		to := filepath.Join(tmp, name)
+		err := copyFile(filepath.Join(debDir, name), to)
+		if err != nil {
+			return err
+		}
+		err = os.Chmod(to, 0444)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, entry)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// configValue is the effective value of a setting and where it came
+// from: "flag" when it was given on the command line, "default"
+// otherwise, or "env" for the environment.
+type configValue struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// effectiveConfig returns the value of every flag, after the working
+// directories were resolved, along with the environment variables the
+// tool reads. Secrets are only reported as set or not, and URLs only
+// by the host they point at.
+func effectiveConfig() map[string]configValue {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	out := make(map[string]configValue)
+	flag.VisitAll(func(f *flag.Flag) {
+		source := "default"
+		if set[f.Name] {
+			source = "flag"
+		}
+		out[f.Name] = configValue{
+			Value:  f.Value.String(),
+			Source: source,
+		}
+	})
+	// the working directories are reported resolved rather than
+	// as given
+	for name, dir := range map[string]string{
+		"src":          srcDir,
+		"pkg":          pkgDir,
+		"log":          logDir,
+		"snapshot-dir": snapshotDir,
+		"staging-dir":  stagingDir,
+	} {
+		v := out[name]
+		v.Value = dir
+		out[name] = v
+	}
+	// URLs can carry credentials, in their userinfo or, as for
+	// webhooks, their path and query.
+	for _, name := range []string{
+		"github-api-url", "log-sink", "notify-url", "upload-url",
+	} {
+		v := out[name]
+		v.Value = redactURL(v.Value)
+		out[name] = v
+	}
+	// Credentials are only reported as set or unset.
+	for _, name := range []string{
+		"GITHUB_TOKEN", "UPLOAD_USER", "UPLOAD_PASSWORD",
+	} {
+		value := "unset"
+		if os.Getenv(name) != "" {
+			value = "set"
+		}
+		out[name] = configValue{Value: value, Source: "env"}
+	}
+	return out
+}
+
+// redactURL returns a URL with its userinfo, path and query replaced,
+// leaving where it points.
+func redactURL(s string) string {
+	if s == "" {
+		return ""
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return "redacted"
+	}
+	if u.User != nil {
+		u.User = url.User("redacted")
+	}
+	if strings.Trim(u.Path, "/") != "" {
+		u.Path = "/redacted"
+	}
+	u.RawPath = ""
+	if u.RawQuery != "" {
+		u.RawQuery = "redacted"
+	}
+	u.Fragment = ""
+	return u.String()
+}
+
+func printConfig(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(effectiveConfig())
+}
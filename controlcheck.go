@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"pault.ag/go/debian/control"
+)
+
+// debianPackageName matches a valid Debian package name.
+var debianPackageName = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+$`)
+
+// fieldValue looks up a field of a control stanza, field names are
+// case insensitive.
+func fieldValue(p control.Paragraph, field string) (string, bool) {
+	for name, value := range p.Values {
+		if strings.EqualFold(name, field) {
+			return strings.TrimSpace(value), true
+		}
+	}
+	return "", false
+}
+
+// controlIssues reports the control files that parsed but look
+// malformed: missing or invalid required fields, an empty
+// Build-Depends or no binary packages. These would otherwise resolve
+// dependencies wrongly without any error.
+func controlIssues(repos repoMetaData) errList {
+	var names []string
+	for repo := range repos.ctrlFiles {
+		names = append(names, repo)
+	}
+	sort.Strings(names)
+	var errs errList
+	for _, repo := range names {
+		ctrl := repos.ctrlFiles[repo]
+		issue := func(format string, args ...interface{}) {
+			errs = append(errs, fmt.Errorf("%s: %s", repo,
+				fmt.Sprintf(format, args...)))
+		}
+		src := ctrl.Source.Paragraph
+		name, _ := fieldValue(src, "Source")
+		switch {
+		case name == "":
+			issue("no Source field")
+		case !debianPackageName.MatchString(name):
+			issue("invalid source package name %q", name)
+		}
+		if v, _ := fieldValue(src, "Maintainer"); v == "" {
+			issue("no Maintainer field")
+		}
+		if v, ok := fieldValue(src, "Build-Depends"); ok && v == "" {
+			issue("empty Build-Depends")
+		}
+		if len(ctrl.Binaries) == 0 {
+			issue("no binary packages")
+		}
+		seen := make(map[string]bool)
+		for i, bin := range ctrl.Binaries {
+			pkg, _ := fieldValue(bin.Paragraph, "Package")
+			if pkg == "" {
+				issue("binary stanza %d has no Package field", i+1)
+				continue
+			}
+			if seen[pkg] {
+				issue("binary package %s is declared twice", pkg)
+				continue
+			}
+			seen[pkg] = true
+			if !debianPackageName.MatchString(pkg) {
+				issue("invalid binary package name %q", pkg)
+			}
+			if v, _ := fieldValue(bin.Paragraph, "Architecture"); v == "" {
+				issue("binary package %s has no Architecture", pkg)
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/sockets"
+	"github.com/docker/go-connections/tlsconfig"
+)
+
+// containerHook sees the requests of the docker client a single
+// build's danos-buildpackage builder uses, which gives no other access
+// to the container it creates.
+type containerHook struct {
+	next http.RoundTripper
+	// adjust, when set, changes the config and host config the
+	// container is created with
+	adjust func(*container.Config, *container.HostConfig)
+
+	mu        sync.Mutex
+	id        string
+	oomKilled bool
+}
+
+func (h *containerHook) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch {
+	case req.Method == "POST" &&
+		strings.HasSuffix(req.URL.Path, "/containers/create"):
+		return h.create(req)
+	case req.Method == "GET" && h.container() != "" &&
+		strings.HasSuffix(req.URL.Path,
+			"/containers/"+h.container()+"/json"):
+		return h.inspect(req)
+	}
+	return h.next.RoundTrip(req)
+}
+
+// create adjusts the container before it is created, so it never runs
+// without its limits and mounts, and records its ID.
+func (h *containerHook) create(req *http.Request) (*http.Response, error) {
+	if h.adjust != nil {
+		var err error
+		req, err = h.adjustRequest(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp, buf, err := h.roundTripBody(req)
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		return resp, err
+	}
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if json.Unmarshal(buf, &created) == nil {
+		h.mu.Lock()
+		h.id = created.ID
+		h.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// adjustRequest rewrites a create request's body, which is the
+// container's config with its host config as the HostConfig field.
+func (h *containerHook) adjustRequest(req *http.Request) (*http.Request, error) {
+	buf, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var body map[string]json.RawMessage
+	var cfg container.Config
+	var hc container.HostConfig
+	err = json.Unmarshal(buf, &body)
+	if err == nil {
+		err = json.Unmarshal(buf, &cfg)
+	}
+	if raw, ok := body["HostConfig"]; ok && err == nil {
+		err = json.Unmarshal(raw, &hc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't adjust build container: %v", err)
+	}
+	h.adjust(&cfg, &hc)
+	buf, err = json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(buf, &body)
+	if err != nil {
+		return nil, err
+	}
+	body["HostConfig"], err = json.Marshal(hc)
+	if err != nil {
+		return nil, err
+	}
+	buf, err = json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Body = ioutil.NopCloser(bytes.NewReader(buf))
+	req.ContentLength = int64(len(buf))
+	req.GetBody = nil
+	return req, nil
+}
+
+// inspect records whether the container was OOM-killed when the
+// builder inspects it after it exits.
+func (h *containerHook) inspect(req *http.Request) (*http.Response, error) {
+	resp, buf, err := h.roundTripBody(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	var info struct {
+		State struct {
+			OOMKilled bool
+		}
+	}
+	if json.Unmarshal(buf, &info) == nil && info.State.OOMKilled {
+		h.mu.Lock()
+		h.oomKilled = true
+		h.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// roundTripBody sends req and reads the response body, leaving it to
+// be read again by the client.
+func (h *containerHook) roundTripBody(req *http.Request) (*http.Response, []byte, error) {
+	resp, err := h.next.RoundTrip(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	buf, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(buf))
+	return resp, buf, nil
+}
+
+// container returns the ID of the container the build created, if it
+// has created one.
+func (h *containerHook) container() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.id
+}
+
+// killedForMemory reports whether the container was OOM-killed.
+func (h *containerHook) killedForMemory() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.oomKilled
+}
+
+// newHookedClient returns a docker client configured from the
+// environment like client.NewEnvClient, whose requests go through
+// hook. The client only accepts an *http.Transport, so the hook is
+// registered as the transport's handler for its URL schemes.
+func newHookedClient(hook *containerHook) (*client.Client, error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = client.DefaultDockerHost
+	}
+	version := os.Getenv("DOCKER_API_VERSION")
+	if version == "" {
+		version = client.DefaultVersion
+	}
+	proto, addr, _, err := client.ParseHost(host)
+	if err != nil {
+		return nil, err
+	}
+	outer, inner := new(http.Transport), new(http.Transport)
+	if certs := os.Getenv("DOCKER_CERT_PATH"); certs != "" {
+		tlsc, err := tlsconfig.Client(tlsconfig.Options{
+			CAFile:             filepath.Join(certs, "ca.pem"),
+			CertFile:           filepath.Join(certs, "cert.pem"),
+			KeyFile:            filepath.Join(certs, "key.pem"),
+			InsecureSkipVerify: os.Getenv("DOCKER_TLS_VERIFY") == "",
+		})
+		if err != nil {
+			return nil, err
+		}
+		outer.TLSClientConfig = tlsc
+		inner.TLSClientConfig = tlsc
+	}
+	for _, t := range []*http.Transport{outer, inner} {
+		err := sockets.ConfigureTransport(t, proto, addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	hook.next = inner
+	outer.RegisterProtocol("http", hook)
+	outer.RegisterProtocol("https", hook)
+	return client.NewClient(host, version,
+		&http.Client{Transport: outer}, nil)
+}
+
+// stopContainer removes a build's container once the build was
+// cancelled. danos-buildpackage removes it with the cancelled context
+// so it would otherwise be left running.
+func stopContainer(cli *client.Client, hook *containerHook) {
+	id := hook.container()
+	if id == "" {
+		return
+	}
+	cli.ContainerRemove(context.Background(), id,
+		types.ContainerRemoveOptions{Force: true})
+}
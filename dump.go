@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"pault.ag/go/debian/dependency"
+)
+
+// controlDep is a build dependency as resolved against the repos in
+// the tree.
+type controlDep struct {
+	Relation string   `json:"relation"`
+	Repos    []string `json:"repos,omitempty"`
+}
+
+// controlBinary is a binary package of a control file.
+type controlBinary struct {
+	Package  string   `json:"package"`
+	Depends  string   `json:"depends,omitempty"`
+	Provides []string `json:"provides,omitempty"`
+}
+
+// controlDump is a control file as this tool interprets it.
+type controlDump struct {
+	Repo         string          `json:"repo"`
+	Source       string          `json:"source"`
+	BuildDepends []controlDep    `json:"build_depends"`
+	Binaries     []controlBinary `json:"binaries"`
+}
+
+func (d controlDump) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Repo: %s\n", d.Repo)
+	fmt.Fprintf(&b, "Source: %s\n", d.Source)
+	fmt.Fprintln(&b, "Build-Depends:")
+	for _, dep := range d.BuildDepends {
+		if len(dep.Repos) == 0 {
+			fmt.Fprintf(&b, "  %s (external)\n", dep.Relation)
+			continue
+		}
+		fmt.Fprintf(&b, "  %s -> %s\n", dep.Relation,
+			strings.Join(dep.Repos, ", "))
+	}
+	fmt.Fprintln(&b, "Binaries:")
+	for _, bin := range d.Binaries {
+		fmt.Fprintf(&b, "  %s\n", bin.Package)
+		if bin.Depends != "" {
+			fmt.Fprintf(&b, "    Depends: %s\n", bin.Depends)
+		}
+		if len(bin.Provides) != 0 {
+			fmt.Fprintf(&b, "    Provides: %s\n",
+				strings.Join(bin.Provides, ", "))
+		}
+	}
+	return b.String()
+}
+
+// dumpControl prints how the control file of a repo was parsed and
+// which repos its build dependencies resolve to.
+func dumpControl(repos repoMetaData, repo string) error {
+	ctrl, ok := repos.ctrlFiles[repo]
+	if !ok {
+		for _, err := range repos.skipped {
+			if strings.HasPrefix(err.Error(), repo+":") {
+				return err
+			}
+		}
+		if contains(repos.salvaged, repo) {
+			return fmt.Errorf("%s: control file was salvaged, "+
+				"only its package names are known", repo)
+		}
+		return fmt.Errorf("%s: not in the tree", repo)
+	}
+
+	dump := controlDump{
+		Repo:         repo,
+		Source:       strings.TrimSpace(ctrl.Source.Source),
+		BuildDepends: []controlDep{},
+		Binaries:     []controlBinary{},
+	}
+	for _, rel := range ctrl.Source.BuildDepends.Relations {
+		dep := controlDep{Relation: rel.String()}
+		for _, pos := range rel.Possibilities {
+			name := packageName(pos.Name)
+			if drepo, ok := repos.pack2repo[name]; ok &&
+				!contains(dep.Repos, drepo) {
+				dep.Repos = append(dep.Repos, drepo)
+			}
+		}
+		dump.BuildDepends = append(dump.BuildDepends, dep)
+	}
+	for _, bin := range ctrl.Binaries {
+		cbin := controlBinary{
+			Package: strings.TrimSpace(bin.Package),
+			Depends: bin.Depends.String(),
+		}
+		if providesStr, ok := bin.Values["Provides"]; ok {
+			provides, err := dependency.Parse(providesStr)
+			if err == nil {
+				for _, poss := range provides.GetAllPossibilities() {
+					cbin.Provides = append(cbin.Provides,
+						packageName(poss.Name))
+				}
+			}
+		}
+		dump.Binaries = append(dump.Binaries, cbin)
+	}
+	out.Result("control", dump, dump.String())
+	return nil
+}
+
+// packageProvider is the repo a package name resolves to and how.
+type packageProvider struct {
+	Package string `json:"package"`
+	Repo    string `json:"repo"`
+	// Via is "package" for a binary package, "provides" for a
+	// virtual package and "salvaged" for a package name taken from
+	// an unparseable control file.
+	Via string `json:"via"`
+}
+
+func (p packageProvider) String() string {
+	return fmt.Sprintf("%s: %s (%s)", p.Package, p.Repo, p.Via)
+}
+
+// providerOf looks up the repo that provides a package.
+func providerOf(repos repoMetaData, pkg string) (packageProvider, bool) {
+	name := packageName(pkg)
+	repo, ok := repos.pack2repo[name]
+	if !ok {
+		return packageProvider{}, false
+	}
+	p := packageProvider{Package: name, Repo: repo, Via: "provides"}
+	ctrl, ok := repos.ctrlFiles[repo]
+	if !ok {
+		p.Via = "salvaged"
+		return p, true
+	}
+	for _, bin := range ctrl.Binaries {
+		if strings.TrimSpace(bin.Package) == name {
+			p.Via = "package"
+			break
+		}
+	}
+	return p, true
+}
+
+// listProviders prints the repo providing a package, or every package
+// and its provider for "all".
+func listProviders(repos repoMetaData, pkg string) error {
+	var names []string
+	if pkg == "all" {
+		for name := range repos.pack2repo {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	} else {
+		names = []string{pkg}
+	}
+	providers := []packageProvider{}
+	var b strings.Builder
+	for _, name := range names {
+		p, ok := providerOf(repos, name)
+		if !ok {
+			return fmt.Errorf("%s: no repo in the tree provides it",
+				name)
+		}
+		providers = append(providers, p)
+		fmt.Fprintln(&b, p)
+	}
+	out.Result("providers", providers, b.String())
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const eventsFile = "events.jsonl"
+
+// buildEvent is a scheduling decision made by buildRepos.
+type buildEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Repo   string    `json:"repo"`
+	Level  int       `json:"level"`
+	Status string    `json:"status,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	// Duration of the build in seconds
+	Duration float64 `json:"duration,omitempty"`
+	// Version is the repo's changelog version
+	Version string `json:"version,omitempty"`
+}
+
+// eventLog appends build events to the events file in the log
+// directory, one JSON object per line. Each event is written as it
+// happens so a crashed run still leaves a trace.
+type eventLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// openEventLog opens the events file for appending so the passes of a
+// run that rebuilds bumped dependents share one trace.
+func openEventLog(logDir string) (*eventLog, error) {
+	f, err := os.OpenFile(filepath.Join(logDir, eventsFile),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLog{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// record writes an event, failing to do so only loses the trace so
+// errors are ignored.
+func (l *eventLog) record(ev buildEvent) {
+	ev.Time = time.Now().UTC()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc.Encode(ev)
+}
+
+func (l *eventLog) Close() error {
+	return l.f.Close()
+}
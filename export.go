@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"pault.ag/go/debian/control"
+)
+
+// graphNode is a repo in an exported dependency graph.
+type graphNode struct {
+	ID          string `json:"id"`
+	Base        bool   `json:"base"`
+	Unparseable bool   `json:"unparseable"`
+}
+
+// graphLink is a build dependency of Source on Target.
+type graphLink struct {
+	Source    string `json:"source"`
+	Target    string `json:"target"`
+	Synthetic bool   `json:"synthetic"`
+}
+
+// repoGraph is the repo dependency graph in a form suitable for
+// exporting.
+type repoGraph struct {
+	Nodes []graphNode `json:"nodes"`
+	Links []graphLink `json:"links"`
+}
+
+func isBaseRepo(repo string) bool {
+	switch repo {
+	case "base-files", "lintian-profile-vyatta", kernelRepo:
+		return true
+	}
+	return false
+}
+
+// extractGraph collects the nodes and links of the dependency graph
+// for the repos in order.
+func extractGraph(order []string, repos repoMetaData) repoGraph {
+	out := repoGraph{Nodes: []graphNode{}, Links: []graphLink{}}
+	inOrder := make(map[string]bool)
+	for _, repo := range order {
+		inOrder[repo] = true
+	}
+	unparseable := make(map[string]bool)
+	for _, repo := range repos.unparseable {
+		unparseable[repo] = true
+	}
+	deps := repoDependencies(repos)
+	for _, repo := range order {
+		out.Nodes = append(out.Nodes, graphNode{
+			ID:          repo,
+			Base:        isBaseRepo(repo),
+			Unparseable: unparseable[repo],
+		})
+		for _, dep := range deps[repo] {
+			if !inOrder[dep.repo] {
+				continue
+			}
+			out.Links = append(out.Links, graphLink{
+				Source:    repo,
+				Target:    dep.repo,
+				Synthetic: dep.synthetic,
+			})
+		}
+	}
+	return out
+}
+
+func writeGraphDot(w io.Writer, g repoGraph) error {
+	var b strings.Builder
+	fmt.Fprintln(&b, "digraph \"danos\" {")
+	for _, node := range g.Nodes {
+		var attrs []string
+		if node.Base {
+			attrs = append(attrs, "style=filled")
+		}
+		if node.Unparseable {
+			attrs = append(attrs, "color=red")
+		}
+		fmt.Fprintf(&b, "\t%q", node.ID)
+		if len(attrs) != 0 {
+			fmt.Fprintf(&b, " [%s]", strings.Join(attrs, ","))
+		}
+		fmt.Fprintln(&b, ";")
+	}
+	for _, link := range g.Links {
+		fmt.Fprintf(&b, "\t%q -> %q", link.Source, link.Target)
+		if link.Synthetic {
+			fmt.Fprint(&b, " [style=dashed]")
+		}
+		fmt.Fprintln(&b, ";")
+	}
+	fmt.Fprintln(&b, "}")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeGraphJSON(w io.Writer, g repoGraph) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g)
+}
+
+// writeGraphCSV writes the links of the graph as an edge list, one
+// row per build dependency.
+func writeGraphCSV(w io.Writer, g repoGraph) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"repo", "depends_on", "type"})
+	for _, link := range g.Links {
+		typ := "declared"
+		if link.Synthetic {
+			typ = "synthetic"
+		}
+		cw.Write([]string{link.Source, link.Target, typ})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// emitGraph writes the dependency graph to path in the given format.
+func emitGraph(path, format string, order []string, repos repoMetaData) error {
+	var write func(io.Writer, repoGraph) error
+	switch format {
+	case "dot":
+		write = writeGraphDot
+	case "json":
+		write = writeGraphJSON
+	case "csv":
+		write = writeGraphCSV
+	default:
+		return fmt.Errorf("unknown graph format %q", format)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return write(f, extractGraph(order, repos))
+}
+
+// buildArgs returns the flags that affect how this run builds a repo,
+// for the single repo builds of a generated Makefile to build the
+// same way.
+func buildArgs() []string {
+	args := []string{
+		"-src", resolvePath(srcDir),
+		"-pkg", resolvePath(pkgDir),
+		"-image-name", imageName,
+		"-version", version,
+	}
+	if local {
+		args = append(args, "-local")
+	}
+	if builderName != "docker" {
+		args = append(args, "-builder", builderName,
+			"-sbuild-dist", sbuildDist)
+	}
+	if overlay != "" {
+		args = append(args, "-overlay", resolvePath(overlay))
+	}
+	if arch != "" {
+		args = append(args, "-arch", arch)
+	}
+	if patchDir != "" {
+		args = append(args, "-patch-dir", resolvePath(patchDir))
+	}
+	if stagingDir != "" {
+		args = append(args, "-staging-dir", stagingDir)
+	}
+	if cleanSources {
+		args = append(args, "-clean-source-before-build")
+	}
+	if findPackaging {
+		args = append(args, "-find-packaging")
+	}
+	if casDir != "" {
+		args = append(args, "-cas-dir", resolvePath(casDir))
+	}
+	if snapshotDeps {
+		args = append(args, "-snapshot-deps",
+			"-snapshot-dir", resolvePath(snapshotDir))
+	}
+	if offlineBuild {
+		args = append(args, "-offline-build")
+	}
+	if ccacheDir != "" {
+		args = append(args, "-ccache-dir", resolvePath(ccacheDir))
+	}
+	if buildCPUs != "" {
+		args = append(args, "-build-cpus", buildCPUs)
+	}
+	if buildMemory != "" {
+		args = append(args, "-build-memory", buildMemory)
+	}
+	if sigKeyring != "" {
+		args = append(args, "-verify-deps-signatures",
+			resolvePath(sigKeyring))
+	}
+	args = append(args, repoValueArgs("-packaging-dir", packagingDirs)...)
+	prebuiltDirs := repoValues{}
+	for repo, dir := range prebuilt {
+		prebuiltDirs[repo] = resolvePath(dir)
+	}
+	args = append(args, repoValueArgs("-prebuilt", prebuiltDirs)...)
+	args = append(args, repoValueArgs("-repo-cpus", repoCPUs)...)
+	args = append(args, repoValueArgs("-repo-memory", repoMemory)...)
+	args = append(args, repoValueArgs("-buildpackage-opts", debBuildOpts)...)
+	args = append(args, repoValueArgs("-binaries", binaryFilter)...)
+	return args
+}
+
+// repoValueArgs repeats a per repo flag for each of its values, in
+// repo order so generated files are stable.
+func repoValueArgs(name string, values repoValues) []string {
+	var repos []string
+	for repo := range values {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	var args []string
+	for _, repo := range repos {
+		args = append(args, name, shellQuote(repo+"="+values[repo]))
+	}
+	return args
+}
+
+// writeMakefile writes a Makefile with a target per repo whose
+// prerequisites are the DANOS repos it build-depends on. Each recipe
+// invokes this tool's single repo build, so make -j can drive a
+// parallel build from the dependency graph.
+func writeMakefile(w io.Writer, order []string, repos repoMetaData) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := buildArgs()
+
+	inOrder := make(map[string]bool)
+	for _, repo := range order {
+		inOrder[repo] = true
+	}
+	// Unparseable repos have no known dependencies, keep them
+	// building last by depending on everything else.
+	deps := repoDependencies(repos)
+	var parsed []string
+	for _, repo := range order {
+		if _, ok := deps[repo]; ok {
+			parsed = append(parsed, repo)
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintln(&b, "# Generated by danos-bootstrap, do not edit.")
+	fmt.Fprintln(&b)
+	fmt.Fprintf(&b, "BOOTSTRAP ?= %s\n", self)
+	fmt.Fprintf(&b, "BOOTSTRAP_FLAGS ?= %s\n", strings.Join(args, " "))
+	fmt.Fprintln(&b)
+	fmt.Fprintf(&b, ".PHONY: all %s\n", strings.Join(order, " "))
+	fmt.Fprintf(&b, "all: %s\n", strings.Join(order, " "))
+	for _, repo := range order {
+		prereqs := parsed
+		if d, ok := deps[repo]; ok {
+			prereqs = nil
+			for _, dep := range d {
+				if inOrder[dep.repo] {
+					prereqs = append(prereqs, dep.repo)
+				}
+			}
+		}
+		fmt.Fprintln(&b)
+		fmt.Fprintf(&b, "%s:", repo)
+		for _, prereq := range prereqs {
+			fmt.Fprintf(&b, " %s", prereq)
+		}
+		fmt.Fprintln(&b)
+		fmt.Fprintf(&b, "\t$(BOOTSTRAP) $(BOOTSTRAP_FLAGS) -build-repo %s\n",
+			repo)
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+func emitMakefile(path string, order []string, repos repoMetaData) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeMakefile(f, order, repos)
+}
+
+// graphExport is a portable snapshot of the repo metadata and build
+// order, so the graph can be analyzed without the source tree.
+type graphExport struct {
+	Order []string `json:"order"`
+	// Controls holds the contents of each repo's debian/control.
+	Controls    map[string]string `json:"controls"`
+	Pack2Repo   map[string]string `json:"pack2repo"`
+	Unparseable []string          `json:"unparseable"`
+	Salvaged    []string          `json:"salvaged,omitempty"`
+	Skipped     []string          `json:"skipped,omitempty"`
+}
+
+func exportGraph(path, srcDir string, order []string, repos repoMetaData) error {
+	out := graphExport{
+		Order:    order,
+		Controls: make(map[string]string),
+	}
+	err := out.readControls(srcDir, repos)
+	if err != nil {
+		return err
+	}
+	out.setMetaData(repos)
+	return writeGraphExport(path, out)
+}
+
+// readControls reads the control files of the repos that are missing
+// from the export.
+func (g *graphExport) readControls(srcDir string, repos repoMetaData) error {
+	var names []string
+	for repo := range repos.ctrlFiles {
+		names = append(names, repo)
+	}
+	names = append(names, repos.unparseable...)
+	names = append(names, repos.salvaged...)
+	for _, repo := range names {
+		if _, ok := g.Controls[repo]; ok {
+			continue
+		}
+		buf, err := ioutil.ReadFile(
+			filepath.Join(packagingDir(srcDir, repo), "debian", "control"))
+		if err != nil {
+			return err
+		}
+		g.Controls[repo] = string(buf)
+	}
+	return nil
+}
+
+// setMetaData records the parsed metadata in the export.
+func (g *graphExport) setMetaData(repos repoMetaData) {
+	g.Pack2Repo = repos.pack2repo
+	g.Unparseable = repos.unparseable
+	g.Salvaged = repos.salvaged
+	g.Skipped = nil
+	for _, err := range repos.skipped {
+		g.Skipped = append(g.Skipped, err.Error())
+	}
+}
+
+func writeGraphExport(path string, g graphExport) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g)
+}
+
+func readGraphExport(path string) (graphExport, error) {
+	var in graphExport
+	f, err := os.Open(path)
+	if err != nil {
+		return in, err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&in)
+	if err != nil {
+		return in, fmt.Errorf("%s: %s", path, err)
+	}
+	if in.Controls == nil {
+		in.Controls = make(map[string]string)
+	}
+	return in, nil
+}
+
+// importGraph loads the repo metadata from a graph export in place of
+// enumerating a source tree.
+func importGraph(path string) (repoMetaData, error) {
+	in, err := readGraphExport(path)
+	if err != nil {
+		return repoMetaData{}, err
+	}
+	return in.metaData()
+}
+
+// metaData re-parses the control files held by the export.
+func (g graphExport) metaData() (repoMetaData, error) {
+	out := repoMetaData{
+		unparseable: []string{},
+		ctrlFiles:   make(map[string]*control.Control),
+		pack2repo:   make(map[string]string),
+	}
+	skip := make(map[string]bool)
+	for _, repo := range append(g.Unparseable, g.Salvaged...) {
+		skip[repo] = true
+	}
+	var names []string
+	for repo := range g.Controls {
+		names = append(names, repo)
+	}
+	sort.Strings(names)
+	for _, repo := range names {
+		if skip[repo] {
+			continue
+		}
+		ctrl, err := control.ParseControl(bufio.NewReader(
+			strings.NewReader(g.Controls[repo])),
+			filepath.Join(repo, "debian", "control"))
+		if err != nil {
+			return out, fmt.Errorf("%s: %s", repo, err)
+		}
+		out.ctrlFiles[repo] = ctrl
+	}
+	for pkg, repo := range g.Pack2Repo {
+		out.pack2repo[pkg] = repo
+	}
+	if g.Unparseable != nil {
+		out.unparseable = append(out.unparseable, g.Unparseable...)
+	}
+	out.salvaged = append(out.salvaged, g.Salvaged...)
+	for _, msg := range g.Skipped {
+		out.skipped = append(out.skipped, errors.New(msg))
+	}
+	return out, nil
+}
+
+// updateGraph re-reads the control files of the changed repos from
+// srcDir and patches them into a graph export, the rest of the graph
+// is taken from the export as is. Changed repos that are no longer in
+// srcDir are removed from the graph.
+func updateGraph(g graphExport, srcDir string, changed []string) (graphExport, repoMetaData, error) {
+	repos, err := g.metaData()
+	if err != nil {
+		return g, repos, err
+	}
+	var errs errList
+	for _, repo := range changed {
+		repos.removeRepo(repo)
+		delete(g.Controls, repo)
+		info, err := os.Stat(sourceDir(srcDir, repo))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return g, repos, err
+		}
+		err = repos.addRepo(srcDir, info)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	errs = append(errs, repos.duplicateSources()...)
+	err = g.readControls(srcDir, repos)
+	if err != nil {
+		return g, repos, err
+	}
+	g.setMetaData(repos)
+	if len(errs) != 0 {
+		return g, repos, errs
+	}
+	return g, repos, nil
+}
@@ -5,6 +5,9 @@ go 1.13
 require (
 	github.com/Microsoft/go-winio v0.4.16 // indirect
 	github.com/danos/utils v0.0.0-20201029161013-0a7b9d7c48d1
+	github.com/docker/docker v1.13.1
+	github.com/docker/go-connections v0.4.0
+	github.com/docker/go-units v0.4.0
 	github.com/google/go-github v17.0.0+incompatible
 	github.com/google/go-querystring v1.0.0 // indirect
 	github.com/kr/text v0.2.0 // indirect
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"pault.ag/go/debian/dependency"
+)
+
+// imageRef returns the reference of the build image the same way
+// danos-buildpackage resolves it.
+func imageRef() string {
+	ref := imageName + ":" + version
+	if local {
+		return ref
+	}
+	return "registry.hub.docker.com/" + ref
+}
+
+// versionTag matches the docker image tags that -version may name.
+var versionTag = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// checkVersion fails fast on a -version that can't name a build
+// image, rather than failing every build the same way. For a -local
+// image the versions that are available are listed.
+func checkVersion(ctx context.Context) error {
+	if !versionTag.MatchString(version) {
+		return fmt.Errorf("invalid -version %q: must be a docker "+
+			"image tag such as debian10-bootstrap", version)
+	}
+	if !local {
+		return nil
+	}
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		// leave reporting an unusable docker to the build
+		return nil
+	}
+	defer cli.Close()
+	images, err := cli.ImageList(ctx, types.ImageListOptions{})
+	if err != nil {
+		return nil
+	}
+	var available []string
+	for _, image := range images {
+		for _, tag := range image.RepoTags {
+			i := strings.LastIndex(tag, ":")
+			if i < 0 || tag[:i] != imageName {
+				continue
+			}
+			if tag[i+1:] == version {
+				return nil
+			}
+			available = append(available, tag[i+1:])
+		}
+	}
+	sort.Strings(available)
+	return fmt.Errorf("no local %s image for -version %q, "+
+		"available versions: %s", imageName, version,
+		strings.Join(available, ", "))
+}
+
+// runInImage runs cmd in a throwaway container of the build image,
+// in place of its entrypoint, with the given bind mounts, and returns
+// its standard output.
+func runInImage(ctx context.Context, cmd []string, binds ...string) (string, error) {
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return "", err
+	}
+	defer cli.Close()
+
+	ref := imageRef()
+	if !local {
+		r, err := cli.ImagePull(ctx, ref, types.ImagePullOptions{})
+		if err != nil {
+			return "", err
+		}
+		io.Copy(ioutil.Discard, r)
+		r.Close()
+	}
+
+	// The image's shell form entrypoint runs the package build and
+	// ignores Cmd, so cmd has to replace the entrypoint.
+	created, err := cli.ContainerCreate(ctx,
+		&container.Config{Image: ref, Entrypoint: cmd[:1], Cmd: cmd[1:]},
+		&container.HostConfig{Binds: binds}, nil, "")
+	if err != nil {
+		return "", err
+	}
+	defer cli.ContainerRemove(context.Background(), created.ID,
+		types.ContainerRemoveOptions{Force: true})
+
+	err = cli.ContainerStart(ctx, created.ID,
+		types.ContainerStartOptions{})
+	if err != nil {
+		return "", err
+	}
+	code, err := cli.ContainerWait(ctx, created.ID)
+	if err != nil {
+		return "", err
+	}
+	logs, err := cli.ContainerLogs(ctx, created.ID,
+		types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
+	if err != nil {
+		return "", err
+	}
+	defer logs.Close()
+	var stdout, stderr bytes.Buffer
+	_, err = stdcopy.StdCopy(&stdout, &stderr, logs)
+	if err != nil {
+		return "", err
+	}
+	if code != 0 {
+		return "", fmt.Errorf("%s exited %d: %s", strings.Join(cmd, " "),
+			code, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// missingImagePackages returns the packages that the build image's
+// apt sources can not provide.
+func missingImagePackages(ctx context.Context, pkgs []string) ([]string, error) {
+	if len(pkgs) == 0 {
+		return nil, nil
+	}
+	const script = `apt-get update -qq >/dev/null 2>&1
+for p in "$@"; do
+	apt-cache showpkg "$p" 2>/dev/null | grep -q "^Package: " || echo "$p"
+done`
+	out, err := runInImage(ctx,
+		append([]string{"sh", "-c", script, "sh"}, pkgs...))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out), nil
+}
+
+// checkExternalDeps verifies that every package listed in the
+// manifest is either already in debDir or available to the build
+// image.
+func checkExternalDeps(ctx context.Context, manifest, debDir string) error {
+	pkgs, err := readListFile(manifest)
+	if err != nil {
+		return err
+	}
+	var query []string
+	for _, pkg := range pkgs {
+		debs := globPackages(debDir, pkg+"_*.deb")
+		if len(debs) == 0 {
+			query = append(query, pkg)
+		}
+	}
+	missing, err := missingImagePackages(ctx, query)
+	if err != nil {
+		return err
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("required external packages unavailable: %s",
+			strings.Join(missing, " "))
+	}
+	return nil
+}
+
+// unsatisfiedDep is a build dependency of a repo that neither a repo
+// in the tree nor the build image can provide.
+type unsatisfiedDep struct {
+	Repo     string `json:"repo"`
+	Relation string `json:"relation"`
+}
+
+// validateDeps checks that every build dependency of the repos can be
+// satisfied by one of its alternatives, either built by a repo in the
+// tree or available to the build image.
+func validateDeps(ctx context.Context, repos repoMetaData) error {
+	var names []string
+	for repo := range repos.ctrlFiles {
+		names = append(names, repo)
+	}
+	sort.Strings(names)
+
+	type pending struct {
+		repo string
+		rel  dependency.Relation
+	}
+	var external []pending
+	queried := make(map[string]bool)
+	var query []string
+	for _, repo := range names {
+		ctrl := repos.ctrlFiles[repo]
+	relations:
+		for _, rel := range ctrl.Source.BuildDepends.Relations {
+			for _, pos := range rel.Possibilities {
+				if _, ok := repos.pack2repo[packageName(pos.Name)]; ok {
+					continue relations
+				}
+			}
+			external = append(external, pending{repo: repo, rel: rel})
+			for _, pos := range rel.Possibilities {
+				name := packageName(pos.Name)
+				if !queried[name] {
+					queried[name] = true
+					query = append(query, name)
+				}
+			}
+		}
+	}
+
+	missing, err := missingImagePackages(ctx, query)
+	if err != nil {
+		return err
+	}
+	unavailable := make(map[string]bool)
+	for _, pkg := range missing {
+		unavailable[pkg] = true
+	}
+	unsatisfied := []unsatisfiedDep{}
+	var b strings.Builder
+	for _, p := range external {
+		ok := false
+		for _, pos := range p.rel.Possibilities {
+			if !unavailable[packageName(pos.Name)] {
+				ok = true
+				break
+			}
+		}
+		if ok {
+			continue
+		}
+		dep := unsatisfiedDep{Repo: p.repo, Relation: p.rel.String()}
+		unsatisfied = append(unsatisfied, dep)
+		fmt.Fprintf(&b, "%s: unsatisfiable build dependency %s\n",
+			dep.Repo, dep.Relation)
+	}
+	if len(unsatisfied) == 0 {
+		b.WriteString("All build dependencies can be satisfied\n")
+	}
+	out.Result("unsatisfiable_deps", unsatisfied, b.String())
+	if len(unsatisfied) != 0 {
+		return fmt.Errorf("%d build dependencies can't be satisfied",
+			len(unsatisfied))
+	}
+	return nil
+}
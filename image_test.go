@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"pault.ag/go/debian/control"
+)
+
+// imageBuildOutput is what the build image prints when its entrypoint,
+// the package build, runs instead of the command it was given.
+const imageBuildOutput = "dpkg-buildpackage: error: cannot read " +
+	"debian/changelog\nbuildpackage failed\n"
+
+// fakeDaemon serves the docker API requests runInImage makes. Like the
+// build image, a container runs the package build unless its
+// entrypoint is replaced, in which case run provides the command's
+// output and exit code.
+type fakeDaemon struct {
+	run func(cmd []string) (string, int)
+
+	mu      sync.Mutex
+	created []container.Config
+}
+
+func (d *fakeDaemon) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/containers/create"):
+		var body struct {
+			container.Config
+			HostConfig container.HostConfig
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		d.mu.Lock()
+		d.created = append(d.created, body.Config)
+		d.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"Id": "c1"})
+	case strings.HasSuffix(path, "/start"):
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(path, "/wait"):
+		_, code := d.output()
+		json.NewEncoder(w).Encode(map[string]int{"StatusCode": code})
+	case strings.HasSuffix(path, "/logs"):
+		stdout, _ := d.output()
+		hdr := make([]byte, 8)
+		hdr[0] = 1
+		binary.BigEndian.PutUint32(hdr[4:], uint32(len(stdout)))
+		w.Write(hdr)
+		w.Write([]byte(stdout))
+	case req.Method == "DELETE":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// output returns what the last container created prints.
+func (d *fakeDaemon) output() (string, int) {
+	d.mu.Lock()
+	cfg := d.created[len(d.created)-1]
+	d.mu.Unlock()
+	if len(cfg.Entrypoint) == 0 {
+		return imageBuildOutput, 0
+	}
+	return d.run(append(cfg.Entrypoint, cfg.Cmd...))
+}
+
+// startFakeDaemon points the docker client at d, with a -local image
+// so nothing is pulled, until the returned function is called.
+func startFakeDaemon(d *fakeDaemon) func() {
+	srv := httptest.NewServer(d)
+	oldHost, oldLocal := os.Getenv("DOCKER_HOST"), local
+	os.Setenv("DOCKER_HOST", "tcp://"+srv.Listener.Addr().String())
+	os.Unsetenv("DOCKER_CERT_PATH")
+	local = true
+	return func() {
+		srv.Close()
+		os.Setenv("DOCKER_HOST", oldHost)
+		local = oldLocal
+	}
+}
+
+// runWithApt runs cmd on the host with apt-get and apt-cache stubs on
+// the path whose archive has the given packages. The stubs are put in
+// dir.
+func runWithApt(t *testing.T, dir string, archive ...string) func([]string) (string, int) {
+	stubs := map[string]string{
+		"apt-get": "#!/bin/sh\nexit 0\n",
+		"apt-cache": "#!/bin/sh\nfor p in " +
+			strings.Join(archive, " ") + "; do\n" +
+			"\t[ \"$p\" = \"$2\" ] && echo \"Package: $p\"\n" +
+			"done\nexit 0\n",
+	}
+	for name, script := range stubs {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script),
+			0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func(cmd []string) (string, int) {
+		c := exec.Command(cmd[0], cmd[1:]...)
+		c.Env = append(os.Environ(),
+			"PATH="+dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+		out, err := c.Output()
+		if err != nil {
+			t.Errorf("%v: %v", cmd, err)
+			return "", 1
+		}
+		return string(out), 0
+	}
+}
+
+func TestMissingImagePackagesRunsQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer startFakeDaemon(&fakeDaemon{
+		run: runWithApt(t, dir, "libc6", "make"),
+	})()
+
+	missing, err := missingImagePackages(context.Background(),
+		[]string{"libc6", "no-such-package", "make"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"no-such-package"}; !reflect.DeepEqual(missing, want) {
+		t.Errorf("missing = %q, want %q", missing, want)
+	}
+}
+
+// resultRecorder keeps the results of a run.
+type resultRecorder struct {
+	results map[string]interface{}
+}
+
+func (r *resultRecorder) Event(name string, data interface{}, text string) {}
+
+func (r *resultRecorder) Result(key string, value interface{}, text string) {
+	r.results[key] = value
+}
+
+func (r *resultRecorder) Close() error { return nil }
+
+func TestValidateDepsQueriesImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer startFakeDaemon(&fakeDaemon{
+		run: runWithApt(t, dir, "debhelper", "libssl-dev"),
+	})()
+	rec := &resultRecorder{results: make(map[string]interface{})}
+	oldOut := out
+	out = rec
+	defer func() { out = oldOut }()
+
+	ctrl, err := control.ParseControl(bufio.NewReader(strings.NewReader(
+		"Source: a\nBuild-Depends: debhelper, b-dev, "+
+			"libssl-dev | libssl1.0-dev, no-such-dev\n\n"+
+			"Package: a\nArchitecture: any\n")), "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos := repoMetaData{
+		ctrlFiles: map[string]*control.Control{"a": ctrl},
+		pack2repo: map[string]string{"a": "a", "b-dev": "b"},
+	}
+
+	err = validateDeps(context.Background(), repos)
+	if err == nil {
+		t.Error("validateDeps succeeded with an unsatisfiable dependency")
+	}
+	want := []unsatisfiedDep{{Repo: "a", Relation: "no-such-dev"}}
+	if got := rec.results["unsatisfiable_deps"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("unsatisfiable_deps = %v, want %v", got, want)
+	}
+}
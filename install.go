@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// installFailure is a built package that can't be installed in the
+// build image.
+type installFailure struct {
+	Package string `json:"package"`
+	Reason  string `json:"reason"`
+}
+
+// installScript serves the package directories mounted under
+// /mnt/pkgs as an apt repository and simulates installing each
+// package named in its arguments on its own, printing the packages
+// that fail and why.
+const installScript = `set -e
+mkdir /tmp/repo
+for deb in /mnt/pkgs/*/*.deb; do
+	if [ -e "$deb" ]; then ln -s "$deb" /tmp/repo/; fi
+done
+cd /tmp/repo
+dpkg-scanpackages -m . > Packages 2>/dev/null
+echo "deb [trusted=yes] file:/tmp/repo ./" > /etc/apt/sources.list.d/built.list
+apt-get update -qq >/dev/null 2>&1
+set +e
+for p in "$@"; do
+	if ! apt-get install -s -qq "$p" >/tmp/out 2>&1; then
+		printf '%s\t%s\n' "$p" "$(grep -E '^(E:| )' /tmp/out | tr -s '\n ' ' ')"
+	fi
+done`
+
+// builtPackages returns the names of the binary packages in debDir
+// built from the repos that built successfully.
+func builtPackages(debDir, baseDir string, results []repoResult) []string {
+	seen := make(map[string]bool)
+	var pkgs []string
+	for _, res := range results {
+		switch res.Status {
+		case statusBuilt, statusPrebuilt, statusTestFailed:
+		default:
+			continue
+		}
+		ctrl, err := readRepoControl(packagingDir(baseDir, res.Repo))
+		if err != nil {
+			continue
+		}
+		for _, bin := range ctrl.Binaries {
+			pkg := strings.TrimSpace(bin.Package)
+			if seen[pkg] || len(globPackages(debDir, pkg+"_*.deb")) == 0 {
+				continue
+			}
+			seen[pkg] = true
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	sort.Strings(pkgs)
+	return pkgs
+}
+
+// verifyInstalls checks that each package built in this run installs in
+// a fresh container of the build image, with its dependencies
+// resolved from the packages in debDir and the image's apt sources.
+// Installs are simulated so each package is checked on its own,
+// without the maintainer scripts of the others.
+func verifyInstalls(ctx context.Context, debDir string, pkgs []string) ([]installFailure, error) {
+	if len(pkgs) == 0 {
+		return nil, nil
+	}
+	var binds []string
+	for i, dir := range packageDirs(debDir) {
+		binds = append(binds, fmt.Sprintf("%s:/mnt/pkgs/%d:ro",
+			resolvePath(dir), i))
+	}
+	out, err := runInImage(ctx,
+		append([]string{"sh", "-c", installScript, "sh"}, pkgs...),
+		binds...)
+	if err != nil {
+		return nil, err
+	}
+	var failures []installFailure
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		failures = append(failures, installFailure{
+			Package: fields[0],
+			Reason:  strings.TrimSpace(fields[1]),
+		})
+	}
+	return failures, nil
+}
+
+func installSummary(failures []installFailure) string {
+	var b strings.Builder
+	for _, f := range failures {
+		fmt.Fprintf(&b, "not installable: %s: %s\n", f.Package, f.Reason)
+	}
+	return b.String()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestVerifyInstallsRunsInstallScript(t *testing.T) {
+	defer startFakeDaemon(&fakeDaemon{
+		run: func(cmd []string) (string, int) {
+			if len(cmd) < 4 || cmd[0] != "sh" || cmd[1] != "-c" ||
+				cmd[2] != installScript {
+				return fmt.Sprintf("unexpected command %q\n", cmd), 1
+			}
+			var out string
+			for _, pkg := range cmd[4:] {
+				if pkg == "b" {
+					out += "b\tE: Unmet dependencies. b : " +
+						"Depends: c but it is not installable\n"
+				}
+			}
+			return out, 0
+		},
+	})()
+
+	failures, err := verifyInstalls(context.Background(), "debs",
+		[]string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []installFailure{{
+		Package: "b",
+		Reason: "E: Unmet dependencies. b : Depends: c but it is " +
+			"not installable",
+	}}
+	if !reflect.DeepEqual(failures, want) {
+		t.Errorf("failures = %q, want %q", failures, want)
+	}
+}
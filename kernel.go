@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// kernelRepo is built before everything else unless its build
+// dependencies can be resolved with -resolve-kernel.
+const kernelRepo = "linux-vyatta"
+
+// hasSubstitution reports whether a control field still contains a
+// substitution that is expanded at build time, such as ${kernel:Version}
+// or @KVER@.
+func hasSubstitution(s string) bool {
+	return strings.Contains(s, "${") || strings.Count(s, "@") >= 2
+}
+
+// kernelMetadataIssues lists the metadata of the kernel repo that this
+// tool can't resolve. If there are none its real build dependencies
+// can be used instead of building it first.
+func kernelMetadataIssues(repos repoMetaData) []string {
+	var issues []string
+	ctrl, ok := repos.ctrlFiles[kernelRepo]
+	if !ok {
+		for _, err := range repos.skipped {
+			if strings.HasPrefix(err.Error(), kernelRepo+":") {
+				issues = append(issues, err.Error())
+			}
+		}
+		if contains(repos.salvaged, kernelRepo) {
+			issues = append(issues, fmt.Sprintf(
+				"%s: only the package names of the "+
+					"control file were salvaged", kernelRepo))
+		}
+		if len(issues) == 0 {
+			issues = append(issues, fmt.Sprintf(
+				"%s: not in the tree", kernelRepo))
+		}
+		return issues
+	}
+	if bdeps, ok := ctrl.Source.Values["Build-Depends"]; ok &&
+		hasSubstitution(bdeps) {
+		issues = append(issues, fmt.Sprintf(
+			"%s: Build-Depends contains substitutions: %s",
+			kernelRepo, strings.TrimSpace(bdeps)))
+	}
+	for _, bin := range ctrl.Binaries {
+		name := strings.TrimSpace(bin.Package)
+		if hasSubstitution(name) {
+			issues = append(issues, fmt.Sprintf(
+				"%s: binary package name contains "+
+					"substitutions: %s", kernelRepo, name))
+		}
+		if provides, ok := bin.Values["Provides"]; ok &&
+			hasSubstitution(provides) {
+			issues = append(issues, fmt.Sprintf(
+				"%s: Provides of %s contains substitutions: %s",
+				kernelRepo, name, strings.TrimSpace(provides)))
+		}
+	}
+	return issues
+}
+
+// kernelResolved reports whether the kernel's build dependencies are
+// used in place of building it first.
+func kernelResolved(repos repoMetaData) bool {
+	return resolveKernel && len(kernelMetadataIssues(repos)) == 0
+}
+
+// warnKernel explains why -resolve-kernel fell back to building the
+// kernel first.
+func warnKernel(repos repoMetaData) {
+	if !resolveKernel {
+		return
+	}
+	issues := kernelMetadataIssues(repos)
+	if len(issues) == 0 {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "warning: can't resolve the kernel's "+
+		"build dependencies, building it first:")
+	for _, issue := range issues {
+		fmt.Fprintln(os.Stderr, "  "+issue)
+	}
+}
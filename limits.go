@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	units "github.com/docker/go-units"
+)
+
+// errOOMKilled is reported when a build container was killed for
+// exceeding its -build-memory limit.
+const errOOMKilled = "build container was OOM-killed"
+
+// repoLimits returns the CPU and memory limits for building a repo,
+// 0 meaning unlimited.
+func repoLimits(repo string) (float64, int64, error) {
+	cpuStr, memStr := buildCPUs, buildMemory
+	if v, ok := repoCPUs[repo]; ok {
+		cpuStr = v
+	}
+	if v, ok := repoMemory[repo]; ok {
+		memStr = v
+	}
+	var cpus float64
+	var mem int64
+	var err error
+	if cpuStr != "" {
+		cpus, err = strconv.ParseFloat(cpuStr, 64)
+		if err != nil || cpus < 0 {
+			return 0, 0, fmt.Errorf("invalid CPU limit %q", cpuStr)
+		}
+	}
+	if memStr != "" {
+		mem, err = units.RAMInBytes(memStr)
+		if err != nil || mem < 0 {
+			return 0, 0, fmt.Errorf("invalid memory limit %q", memStr)
+		}
+	}
+	return cpus, mem, nil
+}
+
+// checkLimits validates the resource limits before anything is built.
+func checkLimits() error {
+	repos := []string{""}
+	for repo := range repoCPUs {
+		repos = append(repos, repo)
+	}
+	for repo := range repoMemory {
+		repos = append(repos, repo)
+	}
+	limited := false
+	for _, repo := range repos {
+		cpus, mem, err := repoLimits(repo)
+		if err != nil {
+			return err
+		}
+		limited = limited || cpus != 0 || mem != 0
+	}
+	if limited && builderName != "docker" {
+		return fmt.Errorf("resource limits need the docker builder")
+	}
+	if offlineBuild && builderName != "docker" {
+		return fmt.Errorf("-offline-build needs the docker builder")
+	}
+	return nil
+}
+
+// wasOOMKilled reports whether a failed build was OOM-killed, either
+// from its error or, for builds in a child process, its log.
+func wasOOMKilled(err error, logPath string) bool {
+	if err == nil {
+		return false
+	}
+	if strings.Contains(err.Error(), errOOMKilled) {
+		return true
+	}
+	buf, rerr := ioutil.ReadFile(logPath)
+	return rerr == nil && strings.Contains(string(buf), errOOMKilled)
+}
+
+// limitContainer applies the resource limits and -offline-build of a
+// build to its container's host config.
+func limitContainer(cfg buildConfig, hc *container.HostConfig) {
+	if cfg.offline {
+		hc.NetworkMode = "none"
+	}
+	if cfg.cpus != 0 {
+		hc.NanoCPUs = int64(cfg.cpus * 1e9)
+	}
+	if cfg.memory != 0 {
+		hc.Memory = cfg.memory
+		hc.MemorySwap = cfg.memory
+	}
+}
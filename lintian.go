@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+)
+
+// lintianTag matches the tags lintian reports, for example
+// "E: foo source: some-tag extra info".
+var lintianTag = regexp.MustCompile(`^([EW]): [^ :]+( source)?: \S`)
+
+// lintianCounts is the number of lintian issues a build reported.
+type lintianCounts struct {
+	Errors   int `json:"errors"`
+	Warnings int `json:"warnings"`
+}
+
+// lintianIssues counts the lintian errors and warnings in a build log.
+func lintianIssues(logPath string) (lintianCounts, error) {
+	var out lintianCounts
+	f, err := os.Open(logPath)
+	if err != nil {
+		return out, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		m := lintianTag.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		switch m[1] {
+		case "E":
+			out.Errors++
+		case "W":
+			out.Warnings++
+		}
+	}
+	return out, scanner.Err()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/google/go-github/github"
+)
+
+// repoListPage is a page of an organization's repo listing along with
+// the ETag GitHub returned it with.
+type repoListPage struct {
+	ETag     string               `json:"etag"`
+	NextPage int                  `json:"next_page"`
+	Repos    []*github.Repository `json:"repos"`
+}
+
+// repoListCache holds the pages of the organization listings, keyed by
+// organization and repo type, from the last run with -repo-list-cache.
+type repoListCache map[string][]repoListPage
+
+func repoListKey(org string) string {
+	key := org + "/" + repoType
+	if githubAPIURL != "" {
+		// an Enterprise Server's orgs are distinct from
+		// github.com's
+		key = githubAPIURL + " " + key
+	}
+	return key
+}
+
+func readRepoListCache(path string) (repoListCache, error) {
+	cache := make(repoListCache)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&cache)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cache, nil
+}
+
+func writeRepoListCache(path string, cache repoListCache) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(cache)
+}
+
+// listOrgPage fetches a page of an organization's repos. When the page
+// was cached it is requested with its ETag, a 304 Not Modified reply
+// doesn't count against the rate limit and the cached page is used.
+func listOrgPage(
+	ctx context.Context,
+	client *github.Client,
+	org string,
+	page int,
+	cached *repoListPage,
+) (repoListPage, error) {
+	u := fmt.Sprintf("orgs/%s/repos?type=%s&per_page=100&page=%d",
+		org, repoType, page)
+	req, err := client.NewRequest("GET", u, nil)
+	if err != nil {
+		return repoListPage{}, err
+	}
+	if cached != nil && cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+	var repos []*github.Repository
+	resp, err := client.Do(ctx, req, &repos)
+	if cached != nil && resp != nil &&
+		resp.StatusCode == http.StatusNotModified {
+		return *cached, nil
+	}
+	if err != nil {
+		return repoListPage{}, err
+	}
+	return repoListPage{
+		ETag:     resp.Header.Get("ETag"),
+		NextPage: resp.NextPage,
+		Repos:    repos,
+	}, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// logSinkQueue is how many lines are held for the collector
+	// before new ones are dropped.
+	logSinkQueue = 4096
+	// logSinkTimeout bounds connecting and writing to the collector.
+	logSinkTimeout = 5 * time.Second
+	// logSinkRetry is how long to drop lines for after the collector
+	// was unreachable before trying it again.
+	logSinkRetry = 30 * time.Second
+)
+
+// sinkLine is a line of a repo's build output.
+type sinkLine struct {
+	repo string
+	text string
+}
+
+// logSink streams build output to a remote collector as well as the
+// local logs. Lines are queued and dropped when the collector is
+// unavailable or can't keep up so it never holds up a build.
+type logSink struct {
+	network string
+	addr    string
+	syslog  bool
+	lines   chan sinkLine
+	done    chan struct{}
+	dropped int64
+}
+
+// sink is the -log-sink collector, nil when there is none.
+var sink *logSink
+
+// newLogSink starts streaming to the collector at rawurl, one of
+// syslog:// or syslog+tcp:// for syslog messages tagged with the repo,
+// or tcp:// or udp:// for lines prefixed with it.
+func newLogSink(rawurl string) (*logSink, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	s := &logSink{
+		addr:  u.Host,
+		lines: make(chan sinkLine, logSinkQueue),
+		done:  make(chan struct{}),
+	}
+	switch u.Scheme {
+	case "syslog":
+		s.network, s.syslog = "udp", true
+	case "syslog+tcp":
+		s.network, s.syslog = "tcp", true
+	case "tcp", "udp":
+		s.network = u.Scheme
+	default:
+		return nil, fmt.Errorf("%s: unknown log sink scheme %q",
+			rawurl, u.Scheme)
+	}
+	if s.addr == "" {
+		return nil, fmt.Errorf("%s: no log sink address", rawurl)
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *logSink) format(line sinkLine) []byte {
+	if !s.syslog {
+		return []byte(line.repo + ": " + line.text + "\n")
+	}
+	host, _ := os.Hostname()
+	// user.info in the traditional BSD syslog format
+	return []byte(fmt.Sprintf("<14>%s %s %s: %s\n",
+		time.Now().Format(time.Stamp), host, line.repo, line.text))
+}
+
+func (s *logSink) run() {
+	defer close(s.done)
+	var conn net.Conn
+	var retry time.Time
+	for line := range s.lines {
+		if conn == nil {
+			if time.Now().Before(retry) {
+				atomic.AddInt64(&s.dropped, 1)
+				continue
+			}
+			c, err := net.DialTimeout(s.network, s.addr,
+				logSinkTimeout)
+			if err != nil {
+				retry = time.Now().Add(logSinkRetry)
+				atomic.AddInt64(&s.dropped, 1)
+				continue
+			}
+			conn = c
+		}
+		conn.SetWriteDeadline(time.Now().Add(logSinkTimeout))
+		_, err := conn.Write(s.format(line))
+		if err != nil {
+			conn.Close()
+			conn = nil
+			retry = time.Now().Add(logSinkRetry)
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func (s *logSink) send(line sinkLine) {
+	select {
+	case s.lines <- line:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+// Close sends the queued lines, giving up if the collector takes
+// longer than logSinkTimeout, and warns about any that were dropped.
+func (s *logSink) Close() {
+	close(s.lines)
+	select {
+	case <-s.done:
+	case <-time.After(logSinkTimeout):
+	}
+	if n := atomic.LoadInt64(&s.dropped); n != 0 {
+		fmt.Fprintf(os.Stderr,
+			"warning: %d lines weren't sent to the log sink\n", n)
+	}
+}
+
+// closeSink closes the -log-sink collector, if there is one.
+func closeSink() {
+	if sink != nil {
+		sink.Close()
+		sink = nil
+	}
+}
+
+// sinkWriter splits a repo's output into lines for the log sink. It
+// discards the output when there is no sink.
+type sinkWriter struct {
+	sink *logSink
+	repo string
+	buf  []byte
+}
+
+func (s *logSink) writer(repo string) *sinkWriter {
+	return &sinkWriter{sink: s, repo: repo}
+}
+
+func (w *sinkWriter) Write(p []byte) (int, error) {
+	if w.sink == nil {
+		return len(p), nil
+	}
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.sink.send(sinkLine{repo: w.repo, text: string(w.buf[:i])})
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Close sends any output left without a trailing newline.
+func (w *sinkWriter) Close() error {
+	if w.sink != nil && len(w.buf) != 0 {
+		w.sink.send(sinkLine{repo: w.repo, text: string(w.buf)})
+		w.buf = nil
+	}
+	return nil
+}
@@ -8,30 +8,163 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/danos/utils/tsort"
 	"github.com/google/go-github/github"
-	bpkg "jsouthworth.net/go/danos-buildpackage"
 	"pault.ag/go/debian/control"
 	"pault.ag/go/debian/dependency"
 )
 
 var (
-	clone     bool
-	build     bool
-	local     bool
-	srcDir    string
-	pkgDir    string
-	logDir    string
-	imageName string
-	version   string
-	gitRef    string
+	clone            bool
+	build            bool
+	local            bool
+	srcDir           string
+	pkgDir           string
+	logDir           string
+	imageName        string
+	version          string
+	gitRef           string
+	jobs             int
+	buildOne         string
+	makefile         string
+	graphFile        string
+	graphFmt         string
+	retryFrom        string
+	externals        string
+	sbom             bool
+	maxDepth         int
+	noBase           bool
+	noLintianDep     bool
+	salvage          bool
+	fatalUnparseable bool
+	strict           bool
+	packages         stringList
+	updated          stringList
+	exportTo         string
+	importFrom       string
+	testHook         string
+	snapshotDeps     bool
+	snapshotDir      string
+	extraDeps        repoPairs
+	dropDeps         repoPairs
+	depOverrides     string
+	lintFail         bool
+
+	prebuilt = repoValues{}
+
+	apiTimeout  time.Duration
+	builderName string
+	sbuildDist  string
+	repoType    string
+
+	reverse       bool
+	watch         bool
+	watchInterval time.Duration
+
+	jsonOut       bool
+	resolveKernel bool
+	dumpRepo      string
+	overlay       string
+	archivePath   string
+	impactRepo    string
+	asOf          string
+	finishCurrent bool
+	rebuildBumped bool
+	providersOf   string
+	casDir        string
+
+	buildCPUs   string
+	buildMemory string
+	repoCPUs    = repoValues{}
+	repoMemory  = repoValues{}
+
+	startAt   string
+	stopAfter string
+
+	graphStatsMode bool
+	arch           string
+
+	notifyURL      string
+	notifyTemplate string
+	allowFailure   stringList
+
+	patchDir   string
+	untilLevel int
+
+	verifyRef        bool
+	requireComplete  bool
+	diffFrom         string
+	providesSnapshot string
+	providesDiffFrom string
+	workDir          string
+	logSinkTo        string
+	quietRepos       stringList
+	validateDepsMode bool
+	runScript        string
+
+	packagingDirs = repoValues{}
+	binaryFilter  = repoValues{}
+	debBuildOpts  = repoValues{}
+	findPackaging bool
+
+	changedDebian string
+	withDeps      bool
+	failedLog     string
+	orgs          stringList
+	noDeps        bool
+	cloneTimeout  time.Duration
+	offlineBuild  bool
+	criticalMode  bool
+	orderFormat   string
+	sigKeyring    string
+	priorities    stringList
+	sourcesFile   string
+	countMode     bool
+	cleanSources  bool
+	ccacheDir     string
+
+	repoListCacheFile string
+	failArchivedDeps  bool
+	gitParallel       int
+	assertOrder       string
+	stagingDir        string
+	printConfigMode   bool
+	selectQueries     fieldQueries
+	failTailLines     int
+	subgraph          stringList
+	subgraphDeps      bool
+	strictControl     bool
+	updateClones      bool
+	deadline          time.Duration
+	// deadlineAt is when the -deadline of the run is reached
+	deadlineAt time.Time
+
+	githubAPIURL  string
+	estimateMode  bool
+	verifyInstall bool
+	preferBuilt   bool
+
+	uploadBackend   string
+	uploadServer    string
+	uploadRepo      string
+	uploadDist      string
+	uploadComponent string
+	uploadRetries   int
 )
 
 func resolvePath(in string) string {
@@ -43,6 +176,89 @@ func resolvePath(in string) string {
 	return out
 }
 
+// resolveWorkDirs makes the working directories absolute, relative to
+// -workdir when it is set, so output doesn't depend on where the tool
+// is run from.
+func resolveWorkDirs() {
+	for _, dir := range []*string{&srcDir, &pkgDir, &logDir, &snapshotDir} {
+		if workDir != "" && !filepath.IsAbs(*dir) {
+			*dir = filepath.Join(workDir, *dir)
+		}
+		*dir = resolvePath(*dir)
+	}
+	if stagingDir != "" {
+		if workDir != "" && !filepath.IsAbs(stagingDir) {
+			stagingDir = filepath.Join(workDir, stagingDir)
+		}
+		stagingDir = resolvePath(stagingDir)
+	}
+}
+
+// sourceDir returns the directory of a repo, preferring the copy in
+// the -overlay directory over the one in base.
+func sourceDir(base, repo string) string {
+	if overlay != "" {
+		dir := filepath.Join(overlay, repo)
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+	}
+	return filepath.Join(base, repo)
+}
+
+// packagingDir returns the directory of a repo holding its debian
+// packaging. It is the repo itself unless -packaging-dir names a
+// subdirectory, or -find-packaging finds a single one within two
+// levels of a repo without top level packaging.
+func packagingDir(base, repo string) string {
+	dir := sourceDir(base, repo)
+	if sub, ok := packagingDirs[repo]; ok {
+		return filepath.Join(dir, sub)
+	}
+	if !findPackaging {
+		return dir
+	}
+	if _, err := os.Stat(filepath.Join(dir, "debian", "control")); err == nil {
+		return dir
+	}
+	var found []string
+	for _, pattern := range []string{"*", filepath.Join("*", "*")} {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern,
+			"debian", "control"))
+		found = append(found, matches...)
+	}
+	if len(found) != 1 {
+		return dir
+	}
+	return filepath.Dir(filepath.Dir(found[0]))
+}
+
+// sourceEntries lists the entries of base along with those of the
+// -overlay directory, sorted by name. An overlay entry replaces the
+// entry of the same name in base.
+func sourceEntries(base string) ([]os.FileInfo, error) {
+	entries, err := ioutil.ReadDir(base)
+	if err != nil || overlay == "" {
+		return entries, err
+	}
+	overlaid, err := ioutil.ReadDir(overlay)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]os.FileInfo)
+	for _, entry := range append(entries, overlaid...) {
+		byName[entry.Name()] = entry
+	}
+	out := make([]os.FileInfo, 0, len(byName))
+	for _, entry := range byName {
+		out = append(out, entry)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name() < out[j].Name()
+	})
+	return out, nil
+}
+
 type buildError struct {
 	repo string
 	err  error
@@ -61,6 +277,15 @@ func (e cloneError) Error() string {
 	return fmt.Sprintf("clone for %s failed: %s", e.repo, e.err)
 }
 
+type testError struct {
+	repo string
+	err  error
+}
+
+func (e testError) Error() string {
+	return fmt.Sprintf("tests for %s failed: %s", e.repo, e.err)
+}
+
 type errList []error
 
 func (l errList) Error() string {
@@ -71,6 +296,137 @@ func (l errList) Error() string {
 	return buf.String()
 }
 
+// repoValues is a repeatable flag of repo=value pairs.
+type repoValues map[string]string
+
+func (v repoValues) String() string {
+	var pairs []string
+	for repo, val := range v {
+		pairs = append(pairs, repo+"="+val)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v repoValues) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("expected repo=value, got %q", s)
+	}
+	v[kv[0]] = kv[1]
+	return nil
+}
+
+// errCollector accumulates errors and is safe for concurrent use.
+type errCollector struct {
+	mu   sync.Mutex
+	errs errList
+}
+
+func (c *errCollector) add(err error) {
+	c.mu.Lock()
+	c.errs = append(c.errs, err)
+	c.mu.Unlock()
+}
+
+// err returns the collected errors as an errList, or nil if there
+// were none.
+func (c *errCollector) err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.errs) == 0 {
+		return nil
+	}
+	return append(errList{}, c.errs...)
+}
+
+func contains(set []string, elem string) bool {
+	for _, s := range set {
+		if s == elem {
+			return true
+		}
+	}
+	return false
+}
+
+// stringList is a flag of comma separated values that may also be
+// repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	for _, elem := range strings.Split(s, ",") {
+		elem = strings.TrimSpace(elem)
+		if elem != "" {
+			*l = append(*l, elem)
+		}
+	}
+	return nil
+}
+
+// repoPair is a repo=value flag argument.
+type repoPair struct {
+	repo, value string
+}
+
+// repoPairs is a repeatable flag of repo=value pairs where a repo may
+// be given more than once.
+type repoPairs []repoPair
+
+func (p *repoPairs) String() string {
+	var pairs []string
+	for _, pair := range *p {
+		pairs = append(pairs, pair.repo+"="+pair.value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (p *repoPairs) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return fmt.Errorf("expected repo=value, got %q", s)
+	}
+	*p = append(*p, repoPair{repo: kv[0], value: kv[1]})
+	return nil
+}
+
+func (p repoPairs) has(repo, value string) bool {
+	for _, pair := range p {
+		if pair.repo == repo && pair.value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// readDepOverrides reads a file of "extra <repo> <dep>" and
+// "drop <repo> <dep>" lines into the -extra-dep and -drop-dep lists.
+func readDepOverrides(path string) error {
+	lines, err := readListFile(path)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return fmt.Errorf("%s: bad override %q", path, line)
+		}
+		pair := repoPair{repo: fields[1], value: fields[2]}
+		switch fields[0] {
+		case "extra":
+			extraDeps = append(extraDeps, pair)
+		case "drop":
+			dropDeps = append(dropDeps, pair)
+		default:
+			return fmt.Errorf("%s: bad override %q", path, line)
+		}
+	}
+	return nil
+}
+
 func tagIsElementOf(tag string, set []*github.RepositoryTag) bool {
 	for _, elem := range set {
 		if tag == *elem.Name {
@@ -80,241 +436,1771 @@ func tagIsElementOf(tag string, set []*github.RepositoryTag) bool {
 	return false
 }
 
-func cloneRepos(into string) error {
-	os.MkdirAll(into, 0777)
-	client := github.NewClient(nil)
+// apiContext bounds a single GitHub API call by the -api-timeout.
+func apiContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if apiTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, apiTimeout)
+}
+
+// tokenTransport authenticates GitHub API requests.
+type tokenTransport struct {
+	token string
+}
 
-	opt := &github.RepositoryListByOrgOptions{
-		ListOptions: github.ListOptions{PerPage: 100},
+func (t tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "token "+t.token)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// githubClient returns a GitHub client, authenticated with
+// $GITHUB_TOKEN when it is set so private repos can be listed.
+func githubClient() *github.Client {
+	var httpClient *http.Client
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		httpClient = &http.Client{
+			Transport: tokenTransport{token: token},
+		}
 	}
-	// get all pages of results
-	var allRepos []*github.Repository
-	ctx := context.Background()
-	for {
-		repos, resp, err := client.Repositories.ListByOrg(ctx,
-			"danos", opt)
+	if githubAPIURL == "" {
+		return github.NewClient(httpClient)
+	}
+	// checkAPIURL has already validated the URL
+	client, _ := github.NewEnterpriseClient(githubAPIURL,
+		uploadURL(githubAPIURL), httpClient)
+	return client
+}
+
+// checkAPIURL validates the -github-api-url.
+func checkAPIURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("bad GitHub API URL: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("bad GitHub API URL %q: must be an "+
+			"http or https URL", raw)
+	}
+	return nil
+}
+
+// uploadURL derives the upload URL of a GitHub Enterprise Server from
+// its API URL, https://host/api/v3/ uploads to https://host/api/uploads/.
+func uploadURL(apiURL string) string {
+	trimmed := strings.TrimSuffix(apiURL, "/")
+	if strings.HasSuffix(trimmed, "/api/v3") {
+		return strings.TrimSuffix(trimmed, "/v3") + "/uploads/"
+	}
+	return apiURL
+}
+
+func validRepoType(typ string) bool {
+	switch typ {
+	case "all", "public", "private", "forks", "sources", "member":
+		return true
+	}
+	return false
+}
+
+// cloneOrgs returns the GitHub organizations to clone from.
+func cloneOrgs() []string {
+	if len(orgs) == 0 {
+		return []string{"danos"}
+	}
+	return orgs
+}
+
+// listOrgRepos returns every repo of the -repo-type in the -org GitHub
+// organizations. They are cloned into one directory, so when orgs
+// have a repo of the same name the one in the org listed first is
+// used. With -repo-list-cache unchanged pages of the listings are
+// reused from the last run.
+func listOrgRepos(ctx context.Context) ([]*github.Repository, error) {
+	client := githubClient()
+	cache := make(repoListCache)
+	if repoListCacheFile != "" {
+		var err error
+		cache, err = readRepoListCache(repoListCacheFile)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		allRepos = append(allRepos, repos...)
-		if resp.NextPage == 0 {
-			break
+	}
+	var allRepos []*github.Repository
+	owner := make(map[string]string)
+	for _, org := range cloneOrgs() {
+		cached := cache[repoListKey(org)]
+		var pages []repoListPage
+		// get all pages of results
+		for page := 1; ; page++ {
+			var prev *repoListPage
+			if page <= len(cached) {
+				prev = &cached[page-1]
+			}
+			callCtx, cancel := apiContext(ctx)
+			listed, err := listOrgPage(callCtx, client, org, page,
+				prev)
+			cancel()
+			if err != nil {
+				return nil, err
+			}
+			pages = append(pages, listed)
+			for _, repo := range listed.Repos {
+				if first, ok := owner[*repo.Name]; ok {
+					fmt.Fprintf(os.Stderr, "warning: %s/%s "+
+						"is shadowed by %s/%s\n", org,
+						*repo.Name, first, *repo.Name)
+					continue
+				}
+				owner[*repo.Name] = org
+				allRepos = append(allRepos, repo)
+			}
+			if listed.NextPage == 0 {
+				break
+			}
+		}
+		cache[repoListKey(org)] = pages
+	}
+	if repoListCacheFile != "" {
+		err := writeRepoListCache(repoListCacheFile, cache)
+		if err != nil {
+			return nil, err
 		}
-		opt.Page = resp.NextPage
+	}
+	return allRepos, nil
+}
+
+// cloneTimeoutError is the error of a git command killed by
+// -clone-timeout.
+type cloneTimeoutError struct {
+	cmd string
+}
+
+func (e cloneTimeoutError) Error() string {
+	return fmt.Sprintf("git %s timed out after %s", e.cmd, cloneTimeout)
+}
+
+// runCloneCommand runs a git command in dir for the clone step,
+// killing it if it takes longer than -clone-timeout.
+func runCloneCommand(ctx context.Context, dir string, args ...string) error {
+	if cloneTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cloneTimeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Stdout = terminal()
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return cloneTimeoutError{cmd: args[0]}
+	}
+	return err
+}
+
+// reuseClone prepares the existing clone in dir, if there is one, to
+// be updated rather than cloned again. A clone that fails the
+// integrity checks, such as one left by an interrupted clone, is
+// removed so it is cloned from scratch.
+func reuseClone(ctx context.Context, dir string) (bool, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return false, nil
+	}
+	err := verifyClone(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %s is damaged, cloning it "+
+			"again: %v\n", dir, err)
+		return false, os.RemoveAll(dir)
+	}
+	return true, runCloneCommand(ctx, dir, "fetch", "--tags", "origin")
+}
+
+// fastForward brings the branch checked out in an updated clone up to
+// date with its upstream, a tag or commit has nothing to update.
+func fastForward(ctx context.Context, dir string) error {
+	cmd := exec.Command("git", "rev-parse", "--verify", "-q",
+		"@{upstream}")
+	cmd.Dir = dir
+	if cmd.Run() != nil {
+		return nil
+	}
+	return runCloneCommand(ctx, dir, "merge", "--ff-only", "-q",
+		"@{upstream}")
+}
+
+// gitVersion returns the major and minor version of the installed
+// git.
+func gitVersion() (int, int, error) {
+	out, err := exec.Command("git", "version").Output()
+	if err != nil {
+		return 0, 0, err
+	}
+	var major, minor int
+	_, err = fmt.Sscanf(string(out), "git version %d.%d",
+		&major, &minor)
+	return major, minor, err
+}
+
+// gitParallelArgs returns the clone options that fetch with
+// -git-parallel jobs, or none if git is too old to have them.
+func gitParallelArgs() []string {
+	if gitParallel <= 0 {
+		return nil
+	}
+	// fetch.parallel is the newer of the options, from git 2.24
+	major, minor, err := gitVersion()
+	if err != nil || major < 2 || (major == 2 && minor < 24) {
+		fmt.Fprintln(os.Stderr, "warning: -git-parallel needs "+
+			"git 2.24 or later, ignoring it")
+		return nil
+	}
+	n := strconv.Itoa(gitParallel)
+	return []string{
+		"-c", "fetch.parallel=" + n,
+		"-c", "submodule.fetchJobs=" + n,
+	}
+}
+
+func cloneRepos(ctx context.Context, into string) error {
+	os.MkdirAll(into, 0777)
+	allRepos, err := listOrgRepos(ctx)
+	if err != nil {
+		return err
 	}
 
-	var cloneErrs errList
-	for _, repo := range allRepos {
+	parallelArgs := gitParallelArgs()
+	var cloneErrs errCollector
+	refs := clonedRefs{
+		Ref:   gitRef,
+		AsOf:  asOf,
+		Repos: make(map[string]string),
+		Orgs:  make(map[string]string),
+		URLs:  make(map[string]string),
+	}
+	for i, repo := range allRepos {
+		if ctx.Err() != nil {
+			cloneErrs.add(ctx.Err())
+			for _, repo := range allRepos[i:] {
+				if repo.Archived == nil || !*repo.Archived {
+					refs.Missing = append(refs.Missing,
+						*repo.Name)
+				}
+			}
+			break
+		}
 		if repo.Archived != nil && *repo.Archived {
+			refs.Archived = append(refs.Archived, *repo.Name)
 			continue
 		}
 
-		cmd := exec.Command("git", "clone", *repo.CloneURL, *repo.Name)
-		cmd.Dir = filepath.Join(into)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err := cmd.Run()
+		dir := filepath.Join(into, *repo.Name)
+		var reused bool
+		var err error
+		if updateClones {
+			reused, err = reuseClone(ctx, dir)
+		}
+		if err == nil && !reused {
+			args := append([]string{"clone"}, parallelArgs...)
+			err = runCloneCommand(ctx, into, append(args,
+				*repo.CloneURL, *repo.Name)...)
+			if _, ok := err.(cloneTimeoutError); ok {
+				// don't leave a partial clone behind
+				os.RemoveAll(dir)
+			}
+		}
 		if err != nil {
+			refs.Missing = append(refs.Missing, *repo.Name)
 			err = cloneError{repo: *repo.Name, err: err}
-			cloneErrs = append(cloneErrs, err)
+			cloneErrs.add(err)
 			fmt.Fprintln(os.Stderr, "clone", err)
 			continue
 		}
 
-		cmd = exec.Command("git", "checkout", gitRef)
-		cmd.Dir = filepath.Join(into, *repo.Name)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
+		err = runCloneCommand(ctx, dir, "checkout", gitRef)
+		if err == nil && reused {
+			err = fastForward(ctx, dir)
+		}
 		if err != nil {
-			err = cloneError{
-				repo: *repo.Name,
-				err:  fmt.Errorf("the reference did not exist"),
+			if _, ok := err.(cloneTimeoutError); ok {
+				refs.Missing = append(refs.Missing, *repo.Name)
+			} else {
+				err = fmt.Errorf("the reference did not exist")
 			}
-			cloneErrs = append(cloneErrs, err)
+			err = cloneError{repo: *repo.Name, err: err}
+			cloneErrs.add(err)
 			fmt.Fprintln(os.Stderr, "checkout", err)
 			// If we were unable to checkout the correct branch
 			// remove the clone, it would be nice to only clone
 			// the proper branches but the github API has a rate
 			// limit that the tool exceeds.
-			err = os.RemoveAll(cmd.Dir)
+			err = os.RemoveAll(dir)
+			if err != nil {
+				err = cloneError{repo: *repo.Name, err: err}
+				cloneErrs.add(err)
+			}
+			continue
+		}
+
+		if asOf != "" {
+			err = checkoutAsOf(dir, asOf)
 			if err != nil {
 				err = cloneError{repo: *repo.Name, err: err}
-				cloneErrs = append(cloneErrs, err)
+				cloneErrs.add(err)
+				fmt.Fprintln(os.Stderr, "checkout", err)
+				// The repo has no history on the branch at
+				// that time so it was not part of the tree.
+				err = os.RemoveAll(dir)
+				if err != nil {
+					err = cloneError{repo: *repo.Name, err: err}
+					cloneErrs.add(err)
+				}
+				continue
 			}
+		}
+
+		sha, err := repoCommit(dir)
+		if err != nil {
+			refs.Missing = append(refs.Missing, *repo.Name)
+			err = cloneError{repo: *repo.Name, err: err}
+			cloneErrs.add(err)
 			continue
 		}
+		refs.Repos[*repo.Name] = sha
+		refs.URLs[*repo.Name] = *repo.CloneURL
+		if org := repo.GetOwner().GetLogin(); org != "danos" {
+			refs.Orgs[*repo.Name] = org
+		}
 	}
-	if len(cloneErrs) != 0 {
-		return cloneErrs
+	err = writeClonedRefs(into, refs)
+	if err != nil {
+		cloneErrs.add(err)
 	}
-	return nil
+	return cloneErrs.err()
 }
 
 type repoMetaData struct {
 	ctrlFiles   map[string]*control.Control
 	pack2repo   map[string]string
 	unparseable []string
+	// salvaged repos have unparseable control files but their
+	// package names could be extracted, so they can still be
+	// depended upon.
+	salvaged []string
+	// skipped records why repos, or parts of them, were left
+	// out of the build.
+	skipped errList
+	// optedOut repos have a bootstrapSkipFile, they aren't built but
+	// unless it is a hard skip their packages still resolve.
+	optedOut []string
+}
+
+// controlPackageLine matches the lines of a control file that name a
+// package.
+var controlPackageLine = regexp.MustCompile(`(?m)^(?:Source|Package):[ \t]*(\S+)`)
+
+// packageName normalizes a package name for pack2repo lookups by
+// trimming it and stripping any multiarch qualifier, so foo:any is
+// matched with foo.
+func packageName(name string) string {
+	name = strings.TrimSpace(name)
+	if i := strings.Index(name, ":"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// salvagePackages extracts the package names from a control file
+// that can't be parsed.
+func salvagePackages(path string) []string {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var out []string
+	for _, m := range controlPackageLine.FindAllStringSubmatch(
+		string(buf), -1) {
+		out = append(out, m[1])
+	}
+	return out
 }
 
-func enumerateBuildableRepos(from string) repoMetaData {
+func enumerateBuildableRepos(from string) (repoMetaData, error) {
 	out := repoMetaData{
 		unparseable: []string{},
 		ctrlFiles:   make(map[string]*control.Control),
 		pack2repo:   make(map[string]string),
 	}
-	repos, err := ioutil.ReadDir(from)
+	var errs errList
+	repos, err := sourceEntries(from)
 	if err != nil {
 		panic(err)
 	}
 	for _, repo := range repos {
-		path := filepath.Join(from, repo.Name(), "debian", "control")
-		ctrlFile, err := os.Open(path)
+		err := out.addRepo(from, repo)
 		if err != nil {
-			// this repo does not contain a debian package
-			continue
+			errs = append(errs, err)
 		}
-		defer ctrlFile.Close()
-		ctrl, err := control.ParseControl(
-			bufio.NewReader(ctrlFile), path)
-		if err != nil {
-			// if there is a control file but it cannot be parsed
-			// by this tool, we'll attempt to just build it last
-			// the control files should get fixed so this
-			// is unnecessary.
-			out.unparseable = append(out.unparseable, repo.Name())
+	}
+	errs = append(errs, out.duplicateSources()...)
+	if len(errs) != 0 {
+		return out, errs
+	}
+	return out, nil
+}
+
+// duplicateSources reports source package names declared by more than
+// one repo, the packages built from them couldn't be told apart. A
+// missing Source field is left to the control file checks.
+func (m repoMetaData) duplicateSources() errList {
+	sources := make(map[string][]string)
+	for repo, ctrl := range m.ctrlFiles {
+		name := strings.TrimSpace(ctrl.Source.Source)
+		if name == "" {
 			continue
 		}
-		out.ctrlFiles[repo.Name()] = ctrl
-		for _, bin := range ctrl.Binaries {
-			pkgName := strings.TrimSpace(bin.Package)
-			out.pack2repo[pkgName] = repo.Name()
-			providesStr, ok := bin.Values["Provides"]
-			if !ok {
-				continue
-			}
-			provides, err := dependency.Parse(providesStr)
-			if err != nil {
-				continue
-			}
-			for _, poss := range provides.GetAllPossibilities() {
-				name := strings.TrimSpace(poss.Name)
-				out.pack2repo[name] = repo.Name()
-			}
+		sources[name] = append(sources[name], repo)
+	}
+	var names []string
+	for name, repos := range sources {
+		if len(repos) > 1 {
+			names = append(names, name)
 		}
 	}
-	return out
+	sort.Strings(names)
+	var errs errList
+	for _, name := range names {
+		repos := sources[name]
+		sort.Strings(repos)
+		errs = append(errs, fmt.Errorf(
+			"source package %s is declared by repos %s",
+			name, strings.Join(repos, ", ")))
+	}
+	return errs
 }
 
-func determineBuildOrder(repos repoMetaData) []string {
-	depGraph := tsort.New()
-	for repo, ctrl := range repos.ctrlFiles {
-		depGraph.AddVertex(repo)
-		// Assume everything requires our base-files
-		if repo != "base-files" &&
-			repo != "lintian-profile-vyatta" {
-			depGraph.AddEdge(repo, "base-files")
-			depGraph.AddEdge(repo, "lintian-profile-vyatta")
-			if repo != "linux-vyatta" {
-				// The kernel has some funky metadata this
-				// tool can't resolve, so just build it
-				// first.
-				depGraph.AddEdge(repo, "linux-vyatta")
-			}
-		}
+// bootstrapSkipFile in the top level of a repo opts it out of the
+// build. The repo's packages are still known so the repos depending
+// on them resolve those dependencies as DANOS packages, without
+// ordering against it, unless the file contains "hard". It is read
+// before any command line filtering so a repo that opts out can't be
+// brought back with -packages or the like.
+const bootstrapSkipFile = ".bootstrap-skip"
 
-		for _, rel := range ctrl.Source.BuildDepends.Relations {
-			for _, pos := range rel.Possibilities {
-				name := strings.TrimSpace(pos.Name)
-				drepo, ok := repos.pack2repo[name]
-				if !ok {
-					// the dependency is not from
-					// a DANOS repository
-					continue
-				}
-				depGraph.AddEdge(repo, drepo)
+// addRepo adds a repo in from to the metadata unless it opted out
+// with a bootstrapSkipFile.
+func (m *repoMetaData) addRepo(from string, repo os.FileInfo) error {
+	marker, err := ioutil.ReadFile(filepath.Join(
+		sourceDir(from, repo.Name()), bootstrapSkipFile))
+	if err != nil {
+		return m.addControl(from, repo)
+	}
+	if strings.TrimSpace(string(marker)) != "hard" {
+		m.addControl(from, repo)
+		var pkgs []string
+		for pkg, prepo := range m.pack2repo {
+			if prepo == repo.Name() {
+				pkgs = append(pkgs, pkg)
 			}
 		}
+		m.removeRepo(repo.Name())
+		for _, pkg := range pkgs {
+			m.pack2repo[pkg] = repo.Name()
+		}
 	}
+	m.optedOut = append(m.optedOut, repo.Name())
+	return nil
+}
 
-	sorted, err := depGraph.Sort()
+// addControl parses the control file of a repo in from and adds it to
+// the metadata. The error is only returned for control files that
+// can't be parsed under -fatal-unparseable, otherwise the reason a
+// repo was left out is recorded in skipped.
+func (m *repoMetaData) addControl(from string, repo os.FileInfo) error {
+	path := filepath.Join(packagingDir(from, repo.Name()),
+		"debian", "control")
+	ctrlFile, err := os.Open(path)
 	if err != nil {
-		panic(err)
+		// this repo does not contain a debian package
+		if repo.IsDir() {
+			m.skipped = append(m.skipped, fmt.Errorf(
+				"%s: no debian/control", repo.Name()))
+		}
+		return nil
 	}
-
-	return append(sorted, repos.unparseable...)
-}
-
-func buildRepo(
+	defer ctrlFile.Close()
+	ctrl, err := control.ParseControl(
+		bufio.NewReader(ctrlFile), path)
+	if err != nil {
+		// if there is a control file but it cannot be parsed
+		// by this tool, we'll attempt to just build it last
+		// the control files should get fixed so this
+		// is unnecessary.
+		if salvage {
+			pkgs := salvagePackages(path)
+			for _, pkg := range pkgs {
+				m.pack2repo[pkg] = repo.Name()
+			}
+			if len(pkgs) != 0 {
+				m.salvaged = append(m.salvaged, repo.Name())
+				return nil
+			}
+		}
+		err = fmt.Errorf("%s: unparseable control file: %s",
+			repo.Name(), err)
+		m.skipped = append(m.skipped, err)
+		m.unparseable = append(m.unparseable, repo.Name())
+		if fatalUnparseable {
+			return err
+		}
+		return nil
+	}
+	m.ctrlFiles[repo.Name()] = ctrl
+	for _, bin := range ctrl.Binaries {
+		pkgName := strings.TrimSpace(bin.Package)
+		m.pack2repo[pkgName] = repo.Name()
+		providesStr, ok := bin.Values["Provides"]
+		if !ok {
+			continue
+		}
+		provides, err := dependency.Parse(providesStr)
+		if err != nil {
+			m.skipped = append(m.skipped, fmt.Errorf(
+				"%s: unparseable Provides of %s: %s",
+				repo.Name(), pkgName, err))
+			continue
+		}
+		for _, poss := range provides.GetAllPossibilities() {
+			name := packageName(poss.Name)
+			m.pack2repo[name] = repo.Name()
+		}
+	}
+	return nil
+}
+
+// removeRepo drops everything known about a repo from the metadata.
+func (m *repoMetaData) removeRepo(repo string) {
+	delete(m.ctrlFiles, repo)
+	for pkg, prepo := range m.pack2repo {
+		if prepo == repo {
+			delete(m.pack2repo, pkg)
+		}
+	}
+	without := func(repos []string) []string {
+		out := repos[:0:0]
+		for _, r := range repos {
+			if r != repo {
+				out = append(out, r)
+			}
+		}
+		return out
+	}
+	m.unparseable = without(m.unparseable)
+	m.salvaged = without(m.salvaged)
+	m.optedOut = without(m.optedOut)
+	var skipped errList
+	for _, err := range m.skipped {
+		if !strings.HasPrefix(err.Error(), repo+":") {
+			skipped = append(skipped, err)
+		}
+	}
+	m.skipped = skipped
+}
+
+// checkStrict reports everything that was silently left out of the
+// build graph: skipped repos, synthetic dependencies on repos that are
+// not in the tree and build dependencies on archived repos.
+func checkStrict(repos repoMetaData, srcDir string) error {
+	errs := append(errList{}, repos.skipped...)
+	var required []string
+	if !kernelResolved(repos) {
+		required = append(required, kernelRepo)
+	}
+	if !noBase {
+		required = append(required, "base-files")
+		if !noLintianDep {
+			required = append(required, "lintian-profile-vyatta")
+		}
+	}
+	for _, repo := range required {
+		if _, ok := repos.ctrlFiles[repo]; !ok &&
+			!contains(repos.salvaged, repo) {
+			errs = append(errs, fmt.Errorf(
+				"%s: assumed dependency is not in the tree", repo))
+		}
+	}
+
+	refs, _ := readClonedRefs(srcDir)
+	archived := make(map[string]bool)
+	for _, repo := range refs.Archived {
+		archived[repo] = true
+	}
+	errs = append(errs, archivedDependencies(repos, archived)...)
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// archivedDependencies reports the build dependencies of the repos
+// that are only satisfied by an archived repo. The packages of
+// archived repos are unknown, so they are matched on the repo name.
+func archivedDependencies(repos repoMetaData, archived map[string]bool) errList {
+	var names []string
+	for repo := range repos.ctrlFiles {
+		names = append(names, repo)
+	}
+	sort.Strings(names)
+	var errs errList
+	for _, repo := range names {
+		ctrl := repos.ctrlFiles[repo]
+		for _, rel := range ctrl.Source.BuildDepends.Relations {
+			for _, pos := range rel.Possibilities {
+				name := packageName(pos.Name)
+				if _, ok := repos.pack2repo[name]; ok {
+					continue
+				}
+				if archived[name] {
+					errs = append(errs, fmt.Errorf(
+						"%s: build depends on archived repo %s",
+						repo, name))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// buildDep is an edge in the repo build graph.
+type buildDep struct {
+	repo string
+	// synthetic dependencies are assumed by this tool rather
+	// than declared in the repo's Build-Depends.
+	synthetic bool
+}
+
+// repoDependencies maps each parseable or salvaged repo to the DANOS
+// repos that must be built before it.
+func repoDependencies(repos repoMetaData) map[string][]buildDep {
+	ctrls := make(map[string]*control.Control)
+	for repo, ctrl := range repos.ctrlFiles {
+		ctrls[repo] = ctrl
+	}
+	for _, repo := range repos.salvaged {
+		// only the packages of a salvaged repo are known
+		ctrls[repo] = nil
+	}
+	resolved := kernelResolved(repos)
+	isBuilt := make(map[string]bool)
+	built := func(pkg string) bool {
+		if !preferBuilt {
+			return false
+		}
+		b, ok := isBuilt[pkg]
+		if !ok {
+			b = len(globPackages(pkgDir, pkg+"_*.deb"))+
+				len(globPackages(pkgDir, pkg+"_*.udeb")) != 0
+			isBuilt[pkg] = b
+		}
+		return b
+	}
+	deps := make(map[string][]buildDep)
+	for repo, ctrl := range ctrls {
+		seen := make(map[string]int)
+		deps[repo] = []buildDep{}
+		addDep := func(drepo string, synthetic bool) {
+			if drepo == repo || dropDeps.has(repo, drepo) {
+				return
+			}
+			if i, ok := seen[drepo]; ok {
+				deps[repo][i].synthetic =
+					deps[repo][i].synthetic && synthetic
+				return
+			}
+			seen[drepo] = len(deps[repo])
+			deps[repo] = append(deps[repo], buildDep{
+				repo:      drepo,
+				synthetic: synthetic,
+			})
+		}
+		// Synthetic dependencies are only added on repos that
+		// are in the tree, otherwise they would show up in the
+		// build order as phantom repos.
+		addSynthetic := func(drepo string) {
+			if _, ok := ctrls[drepo]; ok {
+				addDep(drepo, true)
+			}
+		}
+		// Assume everything requires our base-files
+		if repo != "base-files" &&
+			repo != "lintian-profile-vyatta" {
+			if !noBase {
+				addSynthetic("base-files")
+				if !noLintianDep {
+					addSynthetic("lintian-profile-vyatta")
+				}
+			}
+			if repo != kernelRepo && !resolved {
+				// The kernel has some funky metadata this
+				// tool can't resolve, so just build it
+				// first.
+				addSynthetic(kernelRepo)
+			}
+		}
+		for _, extra := range extraDeps {
+			if extra.repo != repo {
+				continue
+			}
+			if _, ok := ctrls[extra.value]; ok {
+				addDep(extra.value, false)
+			}
+		}
+		if ctrl == nil {
+			continue
+		}
+
+		var choices [][]repoAlternative
+		for _, rel := range ctrl.Source.BuildDepends.Relations {
+			var alts []repoAlternative
+			for _, pos := range rel.Possibilities {
+				name := packageName(pos.Name)
+				drepo, ok := repos.pack2repo[name]
+				if !ok {
+					// the dependency is not from
+					// a DANOS repository
+					continue
+				}
+				if _, ok := ctrls[drepo]; !ok {
+					// the repo opted out of the
+					// build
+					continue
+				}
+				alts = append(alts, repoAlternative{
+					pkg: name, repo: drepo,
+				})
+			}
+			switch len(alts) {
+			case 0:
+			case 1:
+				addDep(alts[0].repo, false)
+			default:
+				choices = append(choices, alts)
+			}
+		}
+		// Alternatives are chosen once every other dependency
+		// is known so one that adds no edge can be preferred.
+		for _, alts := range choices {
+			addDep(preferredAlternative(alts, seen, built), false)
+		}
+	}
+	return deps
+}
+
+// repoAlternative is a package of a DANOS repo that can satisfy a
+// build dependency with alternatives.
+type repoAlternative struct {
+	pkg  string
+	repo string
+}
+
+// preferredAlternative picks the repo to build for a build dependency
+// whose alternatives are built by several DANOS repos, instead of
+// depending on all of them: with -prefer-built-alternatives one whose
+// package is already in the package directory, then one that is
+// already a dependency, then the first listed as the Debian builders
+// would.
+func preferredAlternative(
+	alts []repoAlternative,
+	deps map[string]int,
+	built func(pkg string) bool,
+) string {
+	for _, alt := range alts {
+		if built(alt.pkg) {
+			return alt.repo
+		}
+	}
+	for _, alt := range alts {
+		if _, ok := deps[alt.repo]; ok {
+			return alt.repo
+		}
+	}
+	return alts[0].repo
+}
+
+func determineBuildOrder(repos repoMetaData) []string {
+	depGraph := tsort.New()
+	for repo, deps := range repoDependencies(repos) {
+		depGraph.AddVertex(repo)
+		for _, dep := range deps {
+			depGraph.AddEdge(repo, dep.repo)
+		}
+	}
+
+	sorted, err := depGraph.Sort()
+	if err != nil {
+		panic(err)
+	}
+
+	return append(sorted, repos.unparseable...)
+}
+
+// prioritizeOrder reorders a build order so the prioritized repos,
+// and the repos they depend on, come as early as their dependencies
+// allow. Other repos keep their relative order, and unparseable repos
+// stay last.
+func prioritizeOrder(order []string, repos repoMetaData, prio []string) []string {
+	deps := repoDependencies(repos)
+	boost := dependencyClosure(prio, repos)
+	index := make(map[string]int)
+	for i, repo := range order {
+		index[repo] = i
+	}
+	// before is how many of a repo's dependencies in the order are
+	// still to be placed.
+	before := make(map[string]int)
+	dependents := make(map[string][]string)
+	var pending, last []string
+	for _, repo := range order {
+		ds, ok := deps[repo]
+		if !ok {
+			last = append(last, repo)
+			continue
+		}
+		pending = append(pending, repo)
+		for _, dep := range ds {
+			if _, ok := index[dep.repo]; ok {
+				before[repo]++
+				dependents[dep.repo] = append(
+					dependents[dep.repo], repo)
+			}
+		}
+	}
+	less := func(a, b string) bool {
+		if boost[a] != boost[b] {
+			return boost[a]
+		}
+		return index[a] < index[b]
+	}
+	out := make([]string, 0, len(order))
+	for len(pending) != 0 {
+		next := -1
+		for i, repo := range pending {
+			if before[repo] == 0 &&
+				(next < 0 || less(repo, pending[next])) {
+				next = i
+			}
+		}
+		if next < 0 {
+			// a cycle the sort broke, keep the rest as is
+			out = append(out, pending...)
+			break
+		}
+		repo := pending[next]
+		pending = append(pending[:next], pending[next+1:]...)
+		out = append(out, repo)
+		for _, d := range dependents[repo] {
+			before[d]--
+		}
+	}
+	return append(out, last...)
+}
+
+// formatOrder presents an order as text in the -order-format.
+func formatOrder(title string, order []string) string {
+	switch orderFormat {
+	case "none":
+		return ""
+	case "lines":
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s (%d repos):\n", title, len(order))
+		width := len(strconv.Itoa(len(order)))
+		for i, repo := range order {
+			fmt.Fprintf(&b, "  %*d %s\n", width, i+1, repo)
+		}
+		return b.String()
+	}
+	return fmt.Sprintf("%s (%d repos): %s", title, len(order), order)
+}
+
+// reverseOrder returns a build order reversed. Unparseable repos are
+// built last because their dependencies are unknown, so they come
+// first in the reversed order. Since their packages are unknown too,
+// no other repo can be ordered against them in either direction.
+func reverseOrder(order []string) []string {
+	out := make([]string, len(order))
+	for i, repo := range order {
+		out[len(order)-1-i] = repo
+	}
+	return out
+}
+
+// buildLevels groups a build order into dependency levels. Each repo
+// only depends on repos in earlier levels, so the repos within a level
+// may be built concurrently. Unparseable repos have no known
+// dependencies and are kept together in a final level so they are
+// still built last.
+func buildLevels(order []string, repos repoMetaData) [][]string {
+	deps := repoDependencies(repos)
+	unparseable := make(map[string]bool)
+	for _, repo := range repos.unparseable {
+		unparseable[repo] = true
+	}
+
+	var levels [][]string
+	var last []string
+	level := make(map[string]int)
+	for _, repo := range order {
+		if unparseable[repo] {
+			last = append(last, repo)
+			continue
+		}
+		l := 0
+		for _, dep := range deps[repo] {
+			if dl, ok := level[dep.repo]; ok && dl >= l {
+				l = dl + 1
+			}
+		}
+		level[repo] = l
+		for len(levels) <= l {
+			levels = append(levels, []string{})
+		}
+		levels[l] = append(levels[l], repo)
+	}
+	if len(last) != 0 {
+		levels = append(levels, last)
+	}
+	return levels
+}
+
+// dependencyClosure returns the given repos and every repo they
+// transitively build-depend on.
+func dependencyClosure(targets []string, repos repoMetaData) map[string]bool {
+	deps := repoDependencies(repos)
+	out := make(map[string]bool)
+	var visit func(repo string)
+	visit = func(repo string) {
+		if out[repo] {
+			return
+		}
+		out[repo] = true
+		for _, dep := range deps[repo] {
+			visit(dep.repo)
+		}
+	}
+	for _, repo := range targets {
+		visit(repo)
+	}
+	return out
+}
+
+// warnUnbuiltDeps warns about the DANOS repos the build set depends on
+// that aren't part of it and have no packages in debDir, building
+// against them will likely fail.
+func warnUnbuiltDeps(buildSet []string, repos repoMetaData, debDir string) {
+	building := make(map[string]bool)
+	for _, repo := range buildSet {
+		building[repo] = true
+	}
+	built := make(map[string]bool)
+	for pkg, repo := range repos.pack2repo {
+		if len(globPackages(debDir, pkg+"_*.deb")) != 0 ||
+			len(globPackages(debDir, pkg+"_*.udeb")) != 0 {
+			built[repo] = true
+		}
+	}
+	deps := repoDependencies(repos)
+	for _, repo := range buildSet {
+		for _, dep := range deps[repo] {
+			if !building[dep.repo] && !built[dep.repo] {
+				fmt.Fprintf(os.Stderr, "warning: %s depends on "+
+					"%s which has no packages in %s\n",
+					repo, dep.repo, debDir)
+			}
+		}
+	}
+}
+
+// resolvePackages maps binary package names to the repos that build
+// them, returning the names that no repo builds.
+func resolvePackages(pkgs []string, repos repoMetaData) ([]string, []string) {
+	var found, unresolved []string
+	for _, pkg := range pkgs {
+		repo, ok := repos.pack2repo[packageName(pkg)]
+		if !ok {
+			unresolved = append(unresolved, pkg)
+			continue
+		}
+		if !contains(found, repo) {
+			found = append(found, repo)
+		}
+	}
+	return found, unresolved
+}
+
+// dependentClosure returns the given repos and every repo that
+// transitively build-depends on them.
+func dependentClosure(changed []string, repos repoMetaData) map[string]bool {
+	rdeps := make(map[string][]string)
+	for repo, deps := range repoDependencies(repos) {
+		for _, dep := range deps {
+			rdeps[dep.repo] = append(rdeps[dep.repo], repo)
+		}
+	}
+	out := make(map[string]bool)
+	var visit func(repo string)
+	visit = func(repo string) {
+		if out[repo] {
+			return
+		}
+		out[repo] = true
+		for _, rdep := range rdeps[repo] {
+			visit(rdep)
+		}
+	}
+	for _, repo := range changed {
+		visit(repo)
+	}
+	return out
+}
+
+// impact reports the repos that transitively build-depend on repo,
+// in build order.
+func impact(order []string, repos repoMetaData, repo string) error {
+	if !contains(order, repo) {
+		return fmt.Errorf("%s: not in the build graph", repo)
+	}
+	closure := dependentClosure([]string{repo}, repos)
+	delete(closure, repo)
+	dependents := filterOrder(order, closure)
+	out.Result("impact", dependents, fmt.Sprintf(
+		"Changing %s rebuilds %d repos: %s",
+		repo, len(dependents), dependents))
+	return nil
+}
+
+// reposWithinDepth returns the parseable repos in the first depth
+// dependency levels of order. Unparseable repos have no known depth
+// and are never included.
+func reposWithinDepth(order []string, repos repoMetaData, depth int) map[string]bool {
+	out := make(map[string]bool)
+	for l, level := range buildLevels(order, repos) {
+		if l >= depth {
+			break
+		}
+		for _, repo := range level {
+			if !contains(repos.unparseable, repo) {
+				out[repo] = true
+			}
+		}
+	}
+	return out
+}
+
+// reposUntilLevel returns the parseable repos of buildSet in its
+// dependency levels 0 to level. Unlike reposWithinDepth the levels are
+// those of the build set alone, as -jobs schedules them: a repo whose
+// dependencies are all already built is in level 0.
+func reposUntilLevel(buildSet []string, repos repoMetaData, level int) map[string]bool {
+	out := make(map[string]bool)
+	for l, members := range buildLevels(buildSet, repos) {
+		if l > level {
+			break
+		}
+		for _, repo := range members {
+			if !contains(repos.unparseable, repo) {
+				out[repo] = true
+			}
+		}
+	}
+	return out
+}
+
+// orderWindow returns the repos of order from start up to and
+// including stop, an empty start or stop leaves that end open.
+func orderWindow(order []string, start, stop string) (map[string]bool, error) {
+	index := func(name string, def int) (int, error) {
+		if name == "" {
+			return def, nil
+		}
+		for i, repo := range order {
+			if repo == name {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("%s: not in the build order", name)
+	}
+	from, err := index(start, 0)
+	if err != nil {
+		return nil, err
+	}
+	to, err := index(stop, len(order)-1)
+	if err != nil {
+		return nil, err
+	}
+	if from > to {
+		return nil, fmt.Errorf("%s comes after %s in the build order",
+			start, stop)
+	}
+	out := make(map[string]bool)
+	for _, repo := range order[from : to+1] {
+		out[repo] = true
+	}
+	return out, nil
+}
+
+// filterOrder returns the repos in order that are in keep, preserving
+// their relative order.
+func filterOrder(order []string, keep map[string]bool) []string {
+	out := []string{}
+	for _, repo := range order {
+		if keep[repo] {
+			out = append(out, repo)
+		}
+	}
+	return out
+}
+
+func buildRepo(
+	ctx context.Context,
 	debDir, baseDir, repo, imageName, version string,
 	local bool,
 ) error {
 	fmt.Println("Building", repo)
-	repoPath := resolvePath(filepath.Join(baseDir, repo))
-	opts := []bpkg.MakeBuilderOption{
-		bpkg.SourceDirectory(repoPath),
-		bpkg.DestinationDirectory(resolvePath(debDir)),
-		bpkg.PreferredPackageDirectory(resolvePath(debDir)),
-		bpkg.ImageName(imageName),
-		bpkg.Version(version),
+	repoPath := resolvePath(packagingDir(baseDir, repo))
+	destDir := archDir(debDir)
+	if cleanSources {
+		err := cleanSource(resolvePath(baseDir), repo)
+		if err != nil {
+			return buildError{repo: repo, err: err}
+		}
+	}
+	revert, err := applyPatches(resolvePath(sourceDir(baseDir, repo)),
+		repo)
+	if err != nil {
+		return buildError{repo: repo, err: err}
+	}
+	defer revert()
+	binaries, err := selectBinaries(repo, repoPath)
+	if err != nil {
+		return buildError{repo: repo, err: err}
+	}
+	deps := resolvePath(debDir)
+	if snapshotDeps {
+		snap := resolvePath(filepath.Join(snapshotDir, repo))
+		err := snapshotPackages(snap, packageDirs(debDir)...)
+		if err != nil {
+			return buildError{repo: repo, err: err}
+		}
+		defer os.RemoveAll(snap)
+		deps = snap
+	} else if arch != "" {
+		merged := resolvePath(filepath.Join(snapshotDir, repo))
+		err := linkPackages(merged, packageDirs(debDir)...)
+		if err != nil {
+			return buildError{repo: repo, err: err}
+		}
+		defer os.RemoveAll(merged)
+		deps = merged
+	}
+	cpus, memory, err := repoLimits(repo)
+	if err != nil {
+		return buildError{repo: repo, err: err}
+	}
+	cfg := buildConfig{
+		ctx:       ctx,
+		cpus:      cpus,
+		memory:    memory,
+		offline:   offlineBuild,
+		ccacheDir: ccacheDir,
+		srcDir:    repoPath,
+		destDir:   resolvePath(destDir),
+		pkgDir:    deps,
+		arch:      arch,
+		imageName: imageName,
+		version:   version,
+		local:     local,
+
+		debBuildOpts: strings.Fields(debBuildOpts[repo]),
+		binaries:     binaries,
+	}
+
+	// Clean checkouts are looked up in, and added to, -cas-dir.
+	var entry string
+	var prefixes map[string]bool
+	var before map[string]os.FileInfo
+	if casDir != "" {
+		key, ok := casKey(repo, repoPath)
+		var err error
+		prefixes, err = artifactPrefixes(repoPath)
+		if ok && err == nil {
+			entry = filepath.Join(casDir, key)
+			hit, err := casFetch(entry, destDir)
+			if err != nil {
+				return buildError{repo: repo, err: err}
+			}
+			if hit {
+				fmt.Println("Using cached packages for", repo,
+					"from", entry)
+				err = binaries.drop(destDir)
+				if err != nil {
+					return buildError{repo: repo, err: err}
+				}
+				err = separateArchAll(debDir, prefixes)
+				if err != nil {
+					return buildError{repo: repo, err: err}
+				}
+				return nil
+			}
+			err = unlinkArtifacts(debDir, prefixes)
+			if err != nil {
+				return buildError{repo: repo, err: err}
+			}
+			before = dirState(destDir)
+		}
+	}
+
+	if stagingDir != "" {
+		// A failed build only leaves its output in staging.
+		stage := stagingFor(repo)
+		os.RemoveAll(stage)
+		err := os.MkdirAll(stage, 0777)
+		if err != nil {
+			return buildError{repo: repo, err: err}
+		}
+		defer os.RemoveAll(stage)
+		cfg.destDir = stage
+	}
+	bldr, err := makeBuilder(builderName, cfg)
+	if err != nil {
+		return buildError{repo: repo, err: err}
+	}
+	defer bldr.Close()
+	err = bldr.Build()
+	if err != nil {
+		return buildError{repo: repo, err: err}
+	}
+	if stagingDir != "" {
+		err = publishStaged(cfg.destDir, destDir)
+		if err != nil {
+			return buildError{repo: repo, err: err}
+		}
+	}
+	if entry != "" {
+		err = casStore(entry, destDir,
+			changedArtifacts(destDir, before, prefixes))
+		if err != nil {
+			return buildError{repo: repo, err: err}
+		}
+	}
+	// Dropped after caching so the cache holds every package.
+	err = binaries.drop(destDir)
+	if err != nil {
+		return buildError{repo: repo, err: err}
+	}
+	err = separateArchAll(debDir, repoPrefixes(repoPath))
+	if err != nil {
+		return buildError{repo: repo, err: err}
+	}
+	return nil
+}
+
+// usePrebuilt copies the already built packages for repo from dir into
+// debDir instead of building the repo.
+func usePrebuilt(debDir, repo, dir string) error {
+	out.Event("prebuilt", map[string]string{"repo": repo, "dir": dir},
+		fmt.Sprintf("Using prebuilt packages for %s from %s", repo, dir))
+	var debs []string
+	for _, pattern := range []string{"*.deb", "*.udeb"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return buildError{repo: repo, err: err}
+		}
+		debs = append(debs, matches...)
+	}
+	if len(debs) == 0 {
+		return buildError{
+			repo: repo,
+			err:  fmt.Errorf("no prebuilt packages in %s", dir),
+		}
+	}
+	destDir := archDir(debDir)
+	err := os.MkdirAll(destDir, 0777)
+	if err != nil {
+		return buildError{repo: repo, err: err}
+	}
+	prefixes := make(map[string]bool)
+	for _, deb := range debs {
+		err := copyFile(deb, filepath.Join(destDir, filepath.Base(deb)))
+		if err != nil {
+			return buildError{repo: repo, err: err}
+		}
+		prefixes[strings.SplitN(filepath.Base(deb), "_", 2)[0]] = true
+	}
+	err = separateArchAll(debDir, prefixes)
+	if err != nil {
+		return buildError{repo: repo, err: err}
+	}
+	return nil
+}
+
+// snapshotPackages copies the packages in dirs into a read only
+// snapshot directory, so a build sees the dependencies as they were
+// when it started even if they are rebuilt while it runs.
+func snapshotPackages(snap string, dirs ...string) error {
+	err := os.RemoveAll(snap)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(snap, 0777)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		for _, pattern := range []string{"*.deb", "*.udeb"} {
+			debs, err := filepath.Glob(filepath.Join(dir, pattern))
+			if err != nil {
+				return err
+			}
+			for _, deb := range debs {
+				to := filepath.Join(snap, filepath.Base(deb))
+				err := copyFile(deb, to)
+				if err != nil {
+					return err
+				}
+				err = os.Chmod(to, 0444)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// stopGrace is how long cancelled builds are given to stop their
+// containers before buildRepos returns.
+const stopGrace = 30 * time.Second
+
+func buildRepos(
+	ctx, stop context.Context,
+	levels [][]string,
+	repos repoMetaData,
+	logDir, debDir, baseDir, imageName, version string,
+	local bool,
+	jobs int,
+) ([]repoResult, error) {
+	var buildErrs errCollector
+	var results []repoResult
+	var mu sync.Mutex
+	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if !deadlineAt.IsZero() {
+		ctx, cancel = context.WithDeadline(ctx, deadlineAt)
+		defer cancel()
+	}
+	failedPath := failedLog
+	if failedPath == "" {
+		failedPath = filepath.Join(logDir, "failed-builds.log")
+	}
+	logf, err := os.OpenFile(failedPath,
+		os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return nil, err
+	}
+	defer logf.Close()
+	events, err := openEventLog(logDir)
+	if err != nil {
+		return nil, err
+	}
+	defer events.Close()
+	var all []string
+	levelOf := make(map[string]int)
+	for i, level := range levels {
+		all = append(all, level...)
+		for _, repo := range level {
+			levelOf[repo] = i
+			events.record(buildEvent{
+				Event: "queued", Repo: repo, Level: i,
+			})
+		}
+	}
+	total := len(all)
+	history, _ := readTimings(filepath.Join(logDir, timingsFile))
+	eta := newETA(history, all, jobs)
+	run := func(repo string) error {
+		if jobs > 1 {
+			// teeAndEval redirects the process wide output
+			// so concurrent builds must run in their own
+			// process.
+			return buildRepoProcess(ctx, logDir, repo)
+		}
+		return teeAndEval(logDir, repo, func() error {
+			return buildRepo(ctx, debDir, baseDir, repo,
+				imageName, version, local)
+		})
+	}
+	build := func(repo string) error {
+		if dir, ok := prebuilt[repo]; ok {
+			return usePrebuilt(debDir, repo, dir)
+		}
+		// Record the inputs before building, later builds
+		// may replace them.
+		inputs := consumedPackages(repo, repos, debDir)
+		if sigKeyring != "" {
+			err := verifyDepSignatures(debDir, inputs,
+				resolvePath(sigKeyring))
+			if err != nil {
+				return buildError{repo: repo, err: err}
+			}
+		}
+		err := run(repo)
+		if err != nil {
+			return err
+		}
+		recordBuilt(repo)
+		if !sbom {
+			return nil
+		}
+		return writeSBOM(logDir, repoSBOM{Repo: repo, Consumed: inputs})
+	}
+	evaluate := func(repo string) (repoResult, error) {
+		res := repoResult{Repo: repo, Status: statusBuilt}
+		if _, ok := prebuilt[repo]; ok {
+			res.Status = statusPrebuilt
+		}
+		res.Version = changelogVersion(packagingDir(baseDir, repo))
+		start := time.Now()
+		events.record(buildEvent{
+			Event: "started", Repo: repo, Level: levelOf[repo],
+			Version: res.Version,
+		})
+		err := build(repo)
+		res.Duration = time.Since(start).Seconds()
+		res.Commit, _ = repoCommit(sourceDir(baseDir, repo))
+		if res.Status == statusBuilt {
+			lint, lerr := lintianIssues(
+				filepath.Join(logDir, repo+".log"))
+			if lerr == nil {
+				res.Lintian = &lint
+			}
+			if err == nil && lintFail && lint.Errors > 0 {
+				err = buildError{
+					repo: repo,
+					err: fmt.Errorf("%d lintian errors",
+						lint.Errors),
+				}
+			}
+		}
+		if err != nil {
+			res.Status = statusFailed
+			if wasOOMKilled(err, filepath.Join(logDir, repo+".log")) {
+				res.Status = statusOOMKilled
+			}
+			res.Error = err.Error()
+			if failTailLines > 0 {
+				res.LogTail, _ = logTail(filepath.Join(logDir,
+					repo+".log"), failTailLines)
+			}
+			return res, err
+		}
+		if testHook != "" && res.Status == statusBuilt {
+			res.Test = statusPassed
+			err = runTestHook(ctx, logDir, debDir, repo)
+			if err != nil {
+				res.Status = statusTestFailed
+				res.Test = statusFailed
+				res.Error = err.Error()
+			}
+		}
+		return res, err
+	}
+	// SIGUSR1 holds back new builds until SIGUSR2 is received.
+	var running int32
+	// building counts the builds yet to return, which once
+	// cancelled are still removing their containers.
+	var building int32
+	gate := newPauseGate()
+	handlePauseSignals(ctx, gate, func() int {
+		return int(atomic.LoadInt32(&running))
+	})
+	// broken repos failed with -allow-failure, weren't started
+	// before the -deadline or were skipped because a dependency was
+	// broken, so their packages are missing.
+	deps := repoDependencies(repos)
+	broken := make(map[string]bool)
+	brokenDep := func(repo string) string {
+		for _, dep := range deps[repo] {
+			if broken[dep.repo] {
+				return dep.repo
+			}
+		}
+		return ""
+	}
+	go func() {
+		sem := make(chan struct{}, jobs)
+		for _, level := range levels {
+			var wg sync.WaitGroup
+			for _, repo := range level {
+				if stop.Err() != nil {
+					break
+				}
+				sem <- struct{}{}
+				if gate.wait(stop) != nil {
+					<-sem
+					break
+				}
+				if pastDeadline(history[repo]) {
+					<-sem
+					mu.Lock()
+					broken[repo] = true
+					results = append(results, repoResult{
+						Repo:   repo,
+						Status: statusSkipped,
+						Error:  "not built before the deadline",
+					})
+					events.record(buildEvent{
+						Event:  "skipped",
+						Repo:   repo,
+						Level:  levelOf[repo],
+						Reason: "deadline",
+					})
+					mu.Unlock()
+					continue
+				}
+				wg.Add(1)
+				atomic.AddInt32(&running, 1)
+				go func(repo string) {
+					defer func() {
+						atomic.AddInt32(&running, -1)
+						<-sem
+						wg.Done()
+					}()
+					mu.Lock()
+					dep := brokenDep(repo)
+					mu.Unlock()
+					res := repoResult{
+						Repo:   repo,
+						Status: statusSkipped,
+						Error:  dep + " was not built",
+					}
+					var err error
+					if dep == "" {
+						atomic.AddInt32(&building, 1)
+						res, err = evaluate(repo)
+						atomic.AddInt32(&building, -1)
+						if err != nil && ctx.Err() ==
+							context.DeadlineExceeded {
+							// reported as skipped once
+							// the builds have stopped
+							return
+						}
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					switch {
+					case dep != "":
+						broken[repo] = true
+						events.record(buildEvent{
+							Event:  "skipped",
+							Repo:   repo,
+							Level:  levelOf[repo],
+							Reason: res.Error,
+						})
+					case err != nil && contains(allowFailure, repo):
+						fmt.Fprintln(logf, err)
+						if res.Status != statusTestFailed {
+							res.Status = statusAllowedFailure
+							broken[repo] = true
+						}
+					case err != nil:
+						buildErrs.add(err)
+						fmt.Fprintln(logf, err)
+					}
+					if dep == "" {
+						events.record(buildEvent{
+							Event:    "finished",
+							Repo:     repo,
+							Level:    levelOf[repo],
+							Status:   res.Status,
+							Version:  res.Version,
+							Reason:   res.Error,
+							Duration: res.Duration,
+						})
+					}
+					results = append(results, res)
+					eta.done(repo)
+					progress := fmt.Sprintf("Progress: %d/%d repos",
+						len(results), total)
+					if eta.known() {
+						progress += ", " + eta.String()
+					}
+					if gate.isPaused() {
+						progress += " (paused)"
+					}
+					out.Event("progress", res, progress)
+				}(repo)
+			}
+			// Only advance once the whole level is built
+			wg.Wait()
+		}
+		close(done)
+	}()
+	stopping := stop.Done()
+wait:
+	for {
+		select {
+		case <-done:
+			out.Event("finished", nil, "finished builds")
+			break wait
+		case <-stopping:
+			if ctx.Err() == nil {
+				out.Event("stopping", nil, "interrupt received, "+
+					"finishing the running builds")
+				stopping = nil
+				continue
+			}
+			out.Event("interrupted", nil, "interrupt received")
+			break wait
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				out.Event("deadline", nil, "deadline reached, "+
+					"stopped the running builds")
+				break wait
+			}
+			out.Event("interrupted", nil, "interrupt received")
+			break wait
+		}
+	}
+	if ctx.Err() != nil {
+		deadline := time.Now().Add(stopGrace)
+		for atomic.LoadInt32(&building) != 0 &&
+			time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// Record the queued repos the interrupt kept from starting,
+	// builds still running when interrupted have no finished event.
+	// Those the deadline stopped are reported as skipped.
+	ran := make(map[string]bool)
+	for _, res := range results {
+		ran[res.Repo] = true
 	}
-	if local {
-		opts = append(opts, bpkg.LocalImage())
+	for _, repo := range all {
+		switch {
+		case ran[repo]:
+		case ctx.Err() == context.DeadlineExceeded:
+			results = append(results, repoResult{
+				Repo:   repo,
+				Status: statusSkipped,
+				Error:  "not built before the deadline",
+			})
+			events.record(buildEvent{
+				Event:  "skipped",
+				Repo:   repo,
+				Level:  levelOf[repo],
+				Reason: "deadline",
+			})
+		case stop.Err() != nil:
+			events.record(buildEvent{
+				Event:  "skipped",
+				Repo:   repo,
+				Level:  levelOf[repo],
+				Reason: "interrupted",
+			})
+		}
 	}
+	results = append([]repoResult{}, results...)
+	return results, buildErrs.err()
+}
+
+// pastDeadline reports whether a build expected to take the given
+// time would not finish before the -deadline.
+func pastDeadline(expected time.Duration) bool {
+	return !deadlineAt.IsZero() &&
+		time.Now().Add(expected).After(deadlineAt)
+}
 
-	bldr, err := bpkg.MakeBuilder(opts...)
+// runTestHook runs the -test-hook command for a built repo, logging
+// its output to <repo>.test.log.
+func runTestHook(ctx context.Context, logdir, debDir, repo string) error {
+	outf, err := os.OpenFile(filepath.Join(logdir, repo+".test.log"),
+		os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
 	if err != nil {
-		return buildError{repo: repo, err: err}
+		return testError{repo: repo, err: err}
 	}
-	defer bldr.Close()
-	err = bldr.Build()
+	defer outf.Close()
+
+	cmdline := strings.NewReplacer(
+		"{repo}", repo,
+		"{debDir}", resolvePath(debDir),
+	).Replace(testHook)
+	cmd := exec.CommandContext(ctx, "sh", "-c", cmdline)
+	cmd.Stdout = outf
+	cmd.Stderr = outf
+	err = cmd.Run()
 	if err != nil {
-		return buildError{repo: repo, err: err}
+		return testError{repo: repo, err: err}
 	}
 	return nil
 }
 
-func buildRepos(
-	repos []string,
-	logDir, debDir, baseDir, imageName, version string,
-	local bool,
-) error {
-	var buildErrs errList
-	done := make(chan struct{})
-	interrupt := make(chan os.Signal)
-	signal.Notify(interrupt, os.Interrupt)
-	logf, err := os.OpenFile(filepath.Join(logDir, "failed-builds.log"),
+// buildRepoProcess builds repo in a child invocation of this tool so
+// that its output can be captured separately from any other builds
+// running at the same time. The child receives the same flags as this
+// process plus -build-repo.
+func buildRepoProcess(ctx context.Context, logdir, repo string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return buildError{repo: repo, err: err}
+	}
+
+	outf, err := os.OpenFile(filepath.Join(logdir, repo+".log"),
 		os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
 	if err != nil {
 		return err
 	}
-	defer logf.Close()
-	go func() {
-		for _, repo := range repos {
-			err := teeAndEval(logDir, repo, func() error {
-				return buildRepo(debDir, baseDir, repo,
-					imageName, version, local)
-			})
-			if err != nil {
-				buildErrs = append(buildErrs, err)
-				fmt.Fprintln(logf, err)
-			}
-		}
-		close(done)
-	}()
-	select {
-	case <-done:
-		fmt.Println("finished builds")
-	case <-interrupt:
-		fmt.Println("interrupt received")
-	}
-	if len(buildErrs) != 0 {
-		return buildErrs
+	defer outf.Close()
+
+	sw := sink.writer(repo)
+	defer sw.Close()
+	tee := io.MultiWriter(repoTerminal(repo), outf, sw)
+
+	args := append([]string{}, os.Args[1:]...)
+	args = append(args, "-build-repo", repo)
+	cmd := exec.Command(self, args...)
+	cmd.Stdout = tee
+	cmd.Stderr = tee
+	cmd.SysProcAttr = buildProcAttr()
+	err = runTerminating(ctx, cmd)
+	if err != nil {
+		return buildError{repo: repo, err: err}
 	}
 	return nil
 }
 
 func teeAndEval(logdir, repo string, fn func() error) error {
+	term := repoTerminal(repo)
 	stdout := os.Stdout
 	stderr := os.Stderr
 	outr, outw, e := os.Pipe()
@@ -331,12 +2217,14 @@ func teeAndEval(logdir, repo string, fn func() error) error {
 	}
 	defer outf.Close()
 
-	out := io.MultiWriter(stdout, outf)
+	sw := sink.writer(repo)
+	defer sw.Close()
+	tee := io.MultiWriter(term, outf, sw)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
-		io.Copy(out, outr)
+		io.Copy(tee, outr)
 		wg.Done()
 	}()
 
@@ -350,8 +2238,201 @@ func teeAndEval(logdir, repo string, fn func() error) error {
 	return rval
 }
 
+// interruptContext returns a context that is cancelled when the
+// process receives an interrupt, and a stop context that is cancelled
+// with it. Under -finish-current-on-interrupt the first interrupt only
+// cancels stop, so no more work is started, and the second cancels
+// ctx as well.
+func interruptContext() (ctx, stop context.Context) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stop, cancelStop := context.WithCancel(ctx)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancelStop()
+		if finishCurrent {
+			<-interrupt
+		}
+		cancel()
+	}()
+	return ctx, stop
+}
+
+// terminateContext is cancelled when a -build-repo child is
+// terminated by its parent or interrupted, so it can stop its build
+// before exiting.
+func terminateContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+	return ctx
+}
+
+// runTerminating runs cmd, asking it to terminate once ctx is done.
+// Unlike exec.CommandContext's kill, it gives builds the chance to
+// clean up their containers and chroots.
+func runTerminating(ctx context.Context, cmd *exec.Cmd) error {
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cmd.Process.Signal(syscall.SIGTERM)
+		case <-done:
+		}
+	}()
+	return cmd.Wait()
+}
+
+// buildProcAttr keeps the processes running builds out of the
+// terminal's process group under -finish-current-on-interrupt, so
+// that an interrupt from the terminal doesn't kill them.
+func buildProcAttr() *syscall.SysProcAttr {
+	if !finishCurrent {
+		return nil
+	}
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// readListFile reads a file with one entry per line, ignoring blank
+// lines and # comments.
+func readListFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line != "" {
+			out = append(out, line)
+		}
+	}
+	return out, scanner.Err()
+}
+
+// runBuild builds the repos in buildSet, which must be in build
+// order, and reports the results.
+func runBuild(ctx, stop context.Context, buildSet []string, repos repoMetaData, uploader packageUploader) error {
+	err := os.MkdirAll(logDir, 0777)
+	if err != nil {
+		return err
+	}
+	checkDrift(srcDir, buildSet)
+	err = os.Remove(filepath.Join(logDir, eventsFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var results []repoResult
+	var buildErr error
+	built := make(map[string]bool)
+	for len(buildSet) != 0 {
+		schedule := [][]string{buildSet}
+		if jobs > 1 {
+			schedule = buildLevels(buildSet, repos)
+		}
+		before := packageVersions(pkgDir)
+		var res []repoResult
+		res, buildErr = buildRepos(ctx, stop, schedule, repos, logDir,
+			pkgDir, srcDir, imageName, version, local, jobs)
+		results = append(results, res...)
+		if !rebuildBumped || buildErr != nil || stop.Err() != nil {
+			break
+		}
+		for _, repo := range buildSet {
+			built[repo] = true
+		}
+		bumped := bumpedDependents(repos, built, before,
+			packageVersions(pkgDir))
+		buildSet = filterOrder(determineBuildOrder(repos), bumped)
+		if len(buildSet) != 0 {
+			out.Event("bumped", buildSet, fmt.Sprintf(
+				"Rebuilding %d repos against bumped versions: %s",
+				len(buildSet), buildSet))
+		}
+	}
+	summary, err := summarizePackages(pkgDir, results)
+	if err != nil {
+		return err
+	}
+	out.Result("repos", results, oomSummary(results)+
+		allowedSummary(results)+lintianSummary(results)+
+		testSummary(results)+tailSummary(results))
+	out.Result("packages", summary, summary.String())
+	report := buildReport{
+		Repos:    results,
+		Packages: summary,
+	}
+	if verifyInstall {
+		failures, err := verifyInstalls(ctx, pkgDir,
+			builtPackages(pkgDir, srcDir, results))
+		if err != nil {
+			return err
+		}
+		report.InstallFailures = failures
+		out.Result("install_failures", failures,
+			installSummary(failures))
+		if len(failures) != 0 && buildErr == nil {
+			buildErr = fmt.Errorf("%d built packages failed to "+
+				"install", len(failures))
+		}
+	}
+	if uploader != nil && buildErr == nil && stop.Err() == nil {
+		uploads := uploadPackages(ctx, uploader, pkgDir, srcDir,
+			results)
+		report.Uploads = uploads
+		out.Result("uploads", uploads, uploadSummary(uploads))
+		for _, res := range uploads {
+			if res.Status == uploadFailed {
+				buildErr = fmt.Errorf("uploading %s failed",
+					res.Repo)
+			}
+		}
+	}
+	err = writeReport(logDir, report)
+	if err != nil {
+		return err
+	}
+	if notifyURL != "" {
+		notify(report)
+	}
+	err = writeTimings(logDir, results)
+	if err != nil {
+		return err
+	}
+	err = writeLogsIndex(logDir, results)
+	if err != nil {
+		return err
+	}
+	if archivePath != "" {
+		err = archiveLogs(archivePath, logDir)
+		if err != nil {
+			return err
+		}
+	}
+	return buildErr
+}
+
 func handleError(err error) {
 	if err != nil {
+		out.Result("error", err.Error(), "")
+		closeSink()
+		out.Close()
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
@@ -360,6 +2441,120 @@ func handleError(err error) {
 func init() {
 	flag.BoolVar(&clone, "clone", false, "Clone all DANOS git repos")
 	flag.BoolVar(&build, "build", false, "Build all cloned repos")
+	flag.BoolVar(&estimateMode, "estimate", false,
+		"instead of building, estimate how long building the "+
+			"selected repos with -jobs would take from past "+
+			"build times")
+	flag.BoolVar(&printConfigMode, "print-config", false,
+		"print the effective value of every setting and where it "+
+			"came from as JSON, then exit")
+	flag.BoolVar(&preferBuilt, "prefer-built-alternatives", false,
+		"resolve a build dependency's alternatives to a repo whose "+
+			"package is already in the package directory, which "+
+			"makes the order depend on that directory's contents")
+	flag.BoolVar(&verifyInstall, "verify-install", false,
+		"after building, check each built package installs in a "+
+			"fresh container of the build image")
+	flag.BoolVar(&strictControl, "strict-control", false,
+		"fail if a control file parses but is missing required "+
+			"fields or has invalid values")
+	flag.BoolVar(&failArchivedDeps, "fail-on-archived-deps", false,
+		"fail if a repo build depends on a repo archived in the "+
+			"organization")
+	flag.BoolVar(&cleanSources, "clean-source-before-build", false,
+		"remove untracked files from each cloned repo before "+
+			"building it, repos that weren't cloned are left alone")
+	flag.BoolVar(&countMode, "count", false,
+		"only count the repos in the source directory by whether "+
+			"their packaging parses, without ordering them")
+	flag.StringVar(&sourcesFile, "sources", "",
+		"populate the source directory from the git bundles and "+
+			"tarballs in this manifest of \"repo bundle|tarball path\" "+
+			"lines, after any -clone")
+	flag.Var(&priorities, "prioritize",
+		"build these repos as early as their dependencies allow "+
+			"(comma separated, may be repeated)")
+	flag.StringVar(&sigKeyring, "verify-deps-signatures", "",
+		"keyring to verify the dpkg-sig signatures of the packages "+
+			"in the package directory with before each build")
+	flag.StringVar(&orderFormat, "order-format", "inline",
+		"how to print the build order: inline, lines (one numbered "+
+			"repo per line) or none")
+	flag.BoolVar(&criticalMode, "critical-path", false,
+		"print the chain of dependencies that takes longest to "+
+			"build, from the build times in the log directory")
+	flag.BoolVar(&offlineBuild, "offline-build", false,
+		"create the build containers without networking so "+
+			"builds only use the package directory and image")
+	flag.StringVar(&githubAPIURL, "github-api-url", "",
+		"API URL of a GitHub Enterprise Server to list the repos "+
+			"from, such as https://host/api/v3/, instead of "+
+			"github.com")
+	flag.StringVar(&repoListCacheFile, "repo-list-cache", "",
+		"keep the GitHub repo listing in this file and only "+
+			"refetch the pages that changed since the last run")
+	flag.DurationVar(&deadline, "deadline", 0,
+		"stop starting builds that wouldn't finish, by their past "+
+			"build times, this long after the run started and "+
+			"stop the running ones once it has passed")
+	flag.BoolVar(&updateClones, "update", false,
+		"with -clone, update the existing clones instead of "+
+			"cloning them again, recloning any that are damaged")
+	flag.IntVar(&gitParallel, "git-parallel", 0,
+		"fetch with this many parallel jobs when cloning, "+
+			"0 for git's default")
+	flag.DurationVar(&cloneTimeout, "clone-timeout", 0,
+		"kill a git clone or checkout that takes longer than this, "+
+			"0 for no limit")
+	flag.BoolVar(&noDeps, "no-deps", false,
+		"with -packages, only build the repos of the packages and "+
+			"not the repos they depend on")
+	flag.Var(&orgs, "org",
+		"GitHub organization to clone, repos in the first listed "+
+			"take precedence (comma separated, may be repeated, "+
+			"default danos)")
+	flag.IntVar(&failTailLines, "fail-tail-lines", 30,
+		"include this many lines from the end of a failed build's "+
+			"log in the summary, 0 for none")
+	flag.StringVar(&failedLog, "failed-log", "",
+		"file to list the failed builds in, failed-builds.log in "+
+			"the log directory if unset")
+	flag.StringVar(&changedDebian, "only-changed-debian", "",
+		"only build the repos whose debian directory changed since "+
+			"this git ref")
+	flag.BoolVar(&withDeps, "with-deps", false,
+		"with -only-changed-debian, also build the repos that "+
+			"depend on the changed ones")
+	flag.Var(debBuildOpts, "buildpackage-opts",
+		"extra dpkg-buildpackage options for a repo, as "+
+			"repo=\"-b -nc\" (sbuild builder only, may be repeated)")
+	flag.Var(binaryFilter, "binaries",
+		"only keep these binary packages of a repo, as "+
+			"repo=pkg,pkg (may be repeated); the others are "+
+			"still built and then dropped, except that sbuild "+
+			"skips the Architecture: all or the other packages "+
+			"when none of them are kept")
+	flag.Var(packagingDirs, "packaging-dir",
+		"subdirectory of a repo holding its debian packaging, as "+
+			"repo=dir (may be repeated)")
+	flag.BoolVar(&findPackaging, "find-packaging", false,
+		"look up to two directories down for the packaging of repos "+
+			"without a top level debian/control")
+	flag.StringVar(&runScript, "emit-run-script", "",
+		"write a bash script that clones and builds the tree in "+
+			"order without this tool")
+	flag.BoolVar(&validateDepsMode, "validate-deps", false,
+		"check that every build dependency is built in the tree or "+
+			"available to the build image")
+	flag.Var(&quietRepos, "quiet",
+		"repos whose build output is only written to their log, "+
+			"not the terminal (comma separated, may be repeated)")
+	flag.StringVar(&logSinkTo, "log-sink", "",
+		"also stream build output to a collector at "+
+			"syslog://, syslog+tcp://, tcp:// or udp://host:port")
+	flag.StringVar(&workDir, "workdir", "",
+		"directory the relative -src, -pkg, -log and -snapshot-dir "+
+			"paths are in, the current directory if unset")
 	flag.StringVar(&srcDir, "src", "src", "source directory")
 	flag.StringVar(&pkgDir, "pkg", "pkg", "package directory")
 	flag.StringVar(&logDir, "log", "log", "log directory")
@@ -371,29 +2566,630 @@ func init() {
 	flag.BoolVar(&local, "local", false,
 		"is the image only on the local system")
 	flag.StringVar(&gitRef, "ref", "", "git reference to checkout")
+	flag.BoolVar(&finishCurrent, "finish-current-on-interrupt", false,
+		"on the first interrupt stop starting builds but let the "+
+			"running ones finish, a second interrupt aborts them")
+	flag.StringVar(&asOf, "as-of", "",
+		"check out the last commit of -ref before this time, "+
+			"in any format git accepts")
+	flag.IntVar(&jobs, "jobs", 1,
+		"number of repos in a dependency level to build concurrently")
+	flag.StringVar(&buildOne, "build-repo", "",
+		"build only the named cloned repo and exit")
+	flag.StringVar(&makefile, "emit-makefile", "",
+		"write a Makefile that builds the repos in dependency order")
+	flag.StringVar(&graphFile, "graph", "",
+		"write the dependency graph to a file")
+	flag.Var(&subgraph, "subgraph",
+		"only write the graph of these repos and their dependencies "+
+			"(comma separated)")
+	flag.BoolVar(&subgraphDeps, "subgraph-dependents", false,
+		"include the repos depending on the -subgraph repos too")
+	flag.StringVar(&graphFmt, "graph-format", "dot",
+		"format of the dependency graph: dot, json or csv, an "+
+			"edge list of repo, depends_on and type")
+	flag.StringVar(&retryFrom, "retry-failed", "",
+		"only build the repos that failed in a previous build report")
+	flag.StringVar(&externals, "require-external", "",
+		"file listing non-DANOS packages that must be available "+
+			"before building")
+	flag.BoolVar(&sbom, "sbom", false,
+		"record the DANOS packages each repo consumed in <repo>.sbom.json")
+	flag.IntVar(&untilLevel, "until-level", -1,
+		"only build levels 0 to this one of the repos being built, "+
+			"counting up from those that depend on no other repo "+
+			"being built, -1 for all")
+	flag.IntVar(&maxDepth, "max-depth", 0,
+		"only build repos within this many dependency levels of "+
+			"the base packages of the whole tree, the levels -json "+
+			"reports as build_levels, 0 for all")
+	flag.BoolVar(&noBase, "no-base-files-assumption", false,
+		"don't assume every repo build-depends on base-files and "+
+			"lintian-profile-vyatta")
+	flag.BoolVar(&noLintianDep, "no-lintian-dep", false,
+		"don't assume every repo build-depends on "+
+			"lintian-profile-vyatta")
+	flag.StringVar(&builderName, "builder", "docker",
+		"package builder to use: docker or sbuild")
+	flag.StringVar(&sbuildDist, "sbuild-dist", "buster",
+		"distribution to build for with the sbuild builder")
+	flag.BoolVar(&lintFail, "fail-on-lintian-error", false,
+		"treat lintian errors as build failures")
+	flag.StringVar(&repoType, "repo-type", "all",
+		"type of org repos to clone: all, public, private, forks, "+
+			"sources or member")
+	flag.BoolVar(&salvage, "salvage-unparseable", false,
+		"extract the package names from unparseable control files "+
+			"so their dependents are still ordered after them")
+	flag.BoolVar(&fatalUnparseable, "fatal-unparseable", false,
+		"fail if a control file can't be parsed or salvaged")
+	flag.BoolVar(&strict, "strict", false,
+		"fail if any repo or dependency would be silently skipped")
+	flag.Var(&selectQueries, "select",
+		"only build the repos whose control file has a field "+
+			"matching a shell pattern, as field=pattern, and "+
+			"their dependencies (may be repeated, all must match)")
+	flag.Var(&packages, "packages",
+		"only build the repos that produce these binary packages "+
+			"and their dependencies (comma separated)")
+	flag.Var(&updated, "update-graph",
+		"re-read only these repos' control files on top of the "+
+			"-from-graph export (comma separated)")
+	flag.StringVar(&exportTo, "export-graph", "",
+		"write the repo metadata and build order to a file")
+	flag.StringVar(&importFrom, "from-graph", "",
+		"read the repo metadata from an -export-graph file instead "+
+			"of the source directory")
+	flag.StringVar(&testHook, "test-hook", "",
+		"command to run after each successful build, {repo} and "+
+			"{debDir} are replaced with the repo and package directory")
+	flag.BoolVar(&snapshotDeps, "snapshot-deps", false,
+		"build each repo against a snapshot of the package directory "+
+			"taken when its build starts")
+	flag.StringVar(&stagingDir, "staging-dir", "",
+		"build each repo into a directory here and only move its "+
+			"packages into the package directory once it succeeds")
+	flag.StringVar(&snapshotDir, "snapshot-dir", "snapshots",
+		"directory to keep the -snapshot-deps snapshots in")
+	flag.Var(&extraDeps, "extra-dep",
+		"order a repo after another repo it doesn't declare a build "+
+			"dependency on, as repo=dep (may be repeated)")
+	flag.Var(&dropDeps, "drop-dep",
+		"ignore a repo's dependency on another repo, as repo=dep "+
+			"(may be repeated)")
+	flag.StringVar(&depOverrides, "dep-overrides", "",
+		"file of \"extra <repo> <dep>\" and \"drop <repo> <dep>\" lines")
+	flag.BoolVar(&reverse, "reverse", false,
+		"print the build order reversed, for tearing down in "+
+			"dependency safe order")
+	flag.BoolVar(&watch, "watch", false,
+		"watch the source repos and rebuild changed repos and "+
+			"their dependents")
+	flag.DurationVar(&watchInterval, "watch-interval", 10*time.Second,
+		"how often to check the source repos for changes")
+	flag.Var(prebuilt, "prebuilt",
+		"use the packages in a directory instead of building a repo, "+
+			"as repo=dir (may be repeated)")
+	flag.DurationVar(&apiTimeout, "api-timeout", time.Minute,
+		"timeout for each GitHub API request, 0 for none")
+	flag.BoolVar(&jsonOut, "json", false,
+		"write the result as a JSON document to stdout and "+
+			"progress as JSON lines to stderr")
+	flag.BoolVar(&resolveKernel, "resolve-kernel", false,
+		"order "+kernelRepo+" by its build dependencies instead of "+
+			"building it first, when its metadata can be resolved")
+	flag.StringVar(&dumpRepo, "dump-control", "",
+		"print the parsed control file of a repo")
+	flag.Var(&allowFailure, "allow-failure",
+		"repos whose failure doesn't fail the build, their "+
+			"dependents are skipped (comma separated, may be "+
+			"repeated)")
+	flag.StringVar(&assertOrder, "assert-order", "",
+		"fail if the build order differs from the one saved in "+
+			"this file, printing the differences")
+	flag.StringVar(&providesSnapshot, "provides-snapshot", "",
+		"save the map of packages, and the packages they Provide, "+
+			"to the repos that build them to this file")
+	flag.StringVar(&providesDiffFrom, "diff-provides", "",
+		"compare the map of packages to repos with one saved by "+
+			"-provides-snapshot, reporting added, removed and "+
+			"moved packages")
+	flag.StringVar(&diffFrom, "diff-order", "",
+		"compare the build order with one saved by -export-graph, "+
+			"-json or as a list of repos")
+	flag.BoolVar(&requireComplete, "require-complete", false,
+		"fail if repos that should have been cloned are missing "+
+			"from the source directory")
+	flag.BoolVar(&verifyRef, "verify-consistent-ref", false,
+		"warn about cloned repos that aren't at the ref the tree "+
+			"was cloned from")
+	flag.StringVar(&patchDir, "patch-dir", "",
+		"directory of <repo>/*.patch files applied to each repo's "+
+			"source before it is built and reverted after")
+	flag.StringVar(&uploadBackend, "upload", "",
+		"after a successful build, upload the built packages with "+
+			"this backend: aptly or artifactory, authenticating "+
+			"as $UPLOAD_USER with $UPLOAD_PASSWORD when set")
+	flag.StringVar(&uploadServer, "upload-url", "",
+		"base URL of the -upload server")
+	flag.StringVar(&uploadRepo, "upload-repo", "",
+		"repository to upload to: the aptly local repo or the "+
+			"Artifactory repository key")
+	flag.StringVar(&uploadDist, "upload-dist", "unstable",
+		"distribution Artifactory indexes uploaded packages under")
+	flag.StringVar(&uploadComponent, "upload-component", "main",
+		"component Artifactory indexes uploaded packages under")
+	flag.IntVar(&uploadRetries, "upload-retries", 3,
+		"times to retry a repo's failed upload")
+	flag.StringVar(&notifyURL, "notify-url", "",
+		"URL to post the build report to when the build finishes")
+	flag.StringVar(&notifyTemplate, "notify-template",
+		defaultNotifyTemplate,
+		"text/template for the message posted to -notify-url")
+	flag.StringVar(&arch, "arch", "",
+		"architecture to build for, its packages are kept in their "+
+			"own directory of the package directory with the "+
+			"architecture independent ones in all, needs "+
+			"-builder sbuild")
+	flag.BoolVar(&graphStatsMode, "graph-stats", false,
+		"print the leaf and root repos and the most depended on repos")
+	flag.StringVar(&providersOf, "list-providers", "",
+		"print the repo that provides a package, or all for "+
+			"every package")
+	flag.StringVar(&impactRepo, "impact", "",
+		"print the repos that need rebuilding if a repo changes")
+	flag.BoolVar(&rebuildBumped, "rebuild-bumped", false,
+		"after building, also rebuild the repos with a versioned "+
+			"build dependency on a package whose new version "+
+			"changed the version satisfying the dependency")
+	flag.StringVar(&ccacheDir, "ccache-dir", "",
+		"compiler cache directory kept across builds, mounted as "+
+			"$CCACHE_DIR in the build containers, for images "+
+			"that build with ccache")
+	flag.StringVar(&casDir, "cas-dir", "",
+		"directory of built packages keyed by commit and build "+
+			"environment, used in place of rebuilding a repo")
+	flag.StringVar(&startAt, "start-at", "",
+		"skip the repos before this one in the build order")
+	flag.StringVar(&stopAfter, "stop-after", "",
+		"skip the repos after this one in the build order")
+	flag.StringVar(&buildCPUs, "build-cpus", "",
+		"number of CPUs each build container may use")
+	flag.StringVar(&buildMemory, "build-memory", "",
+		"memory each build container may use, such as 4g")
+	flag.Var(repoCPUs, "repo-cpus",
+		"override -build-cpus for a repo, as repo=cpus "+
+			"(may be repeated)")
+	flag.Var(repoMemory, "repo-memory",
+		"override -build-memory for a repo, as repo=size "+
+			"(may be repeated)")
+	flag.StringVar(&overlay, "overlay", "",
+		"directory of repos to use in place of the ones in the "+
+			"source directory")
+	flag.StringVar(&archivePath, "archive-logs", "",
+		"bundle the logs and build report into a .tar.gz after "+
+			"the build")
 }
 
 func main() {
 	flag.Parse()
+	if deadline > 0 {
+		deadlineAt = time.Now().Add(deadline)
+	}
+	resolveWorkDirs()
+	if printConfigMode {
+		handleError(printConfig(os.Stdout))
+		return
+	}
+	if buildOne != "" {
+		if dir, ok := prebuilt[buildOne]; ok {
+			handleError(usePrebuilt(pkgDir, buildOne, dir))
+			return
+		}
+		if sigKeyring != "" {
+			handleError(verifyBuildOneDeps(pkgDir, srcDir,
+				buildOne))
+		}
+		err := buildRepo(terminateContext(), pkgDir, srcDir, buildOne,
+			imageName, version, local)
+		handleError(err)
+		return
+	}
+	if jsonOut {
+		out = newJSONOutput()
+	}
+	if logSinkTo != "" {
+		var err error
+		sink, err = newLogSink(logSinkTo)
+		handleError(err)
+	}
+
+	if jobs < 1 {
+		handleError(fmt.Errorf("jobs must be at least 1"))
+	}
+	if githubAPIURL != "" {
+		handleError(checkAPIURL(githubAPIURL))
+	}
+	switch orderFormat {
+	case "inline", "lines", "none":
+	default:
+		handleError(fmt.Errorf("unknown order format %q", orderFormat))
+	}
+	if _, ok := builders[builderName]; !ok {
+		handleError(fmt.Errorf("unknown builder %q", builderName))
+	}
+	handleError(checkLimits())
+	if notifyURL != "" {
+		handleError(parseNotifyTemplate())
+	}
+	var uploader packageUploader
+	if uploadBackend != "" {
+		var err error
+		uploader, err = makeUploader(uploadBackend,
+			uploadConfigFromFlags())
+		handleError(err)
+	}
+	if arch != "" && builderName != "sbuild" {
+		// danos-buildpackage always builds for the host.
+		handleError(fmt.Errorf("-arch needs the sbuild builder"))
+	}
+	if ccacheDir != "" {
+		if builderName != "docker" {
+			// sbuild chroots need ccache set up in their
+			// configuration.
+			handleError(fmt.Errorf("-ccache-dir needs the " +
+				"docker builder"))
+		}
+		ccacheDir = resolvePath(ccacheDir)
+		handleError(os.MkdirAll(ccacheDir, 0777))
+	}
+	if len(debBuildOpts) != 0 && builderName != "sbuild" {
+		// danos-buildpackage runs its own dpkg-buildpackage
+		// command with no way to add options.
+		handleError(fmt.Errorf("-buildpackage-opts needs the " +
+			"sbuild builder"))
+	}
+
+	if depOverrides != "" {
+		handleError(readDepOverrides(depOverrides))
+	}
+
+	ctx, stop := interruptContext()
+
+	if (build || watch) && builderName == "docker" {
+		handleError(checkVersion(ctx))
+	}
+
 	if clone {
 		if gitRef == "" {
 			handleError(fmt.Errorf("Must supply git ref to clone"))
 		}
-		err := cloneRepos(srcDir)
+		if !validRepoType(repoType) {
+			handleError(fmt.Errorf("unknown repo type %q", repoType))
+		}
+		err := cloneRepos(stop, srcDir)
 		handleError(err)
 	}
+	if sourcesFile != "" {
+		handleError(prepareSources(stop, srcDir, sourcesFile))
+	}
+	if verifyRef {
+		handleError(verifyConsistentRef(srcDir))
+	}
+	if requireComplete {
+		handleError(checkComplete(ctx, srcDir))
+	}
 
-	repos := enumerateBuildableRepos(srcDir)
+	var repos repoMetaData
+	var graph graphExport
+	var err error
+	if len(updated) != 0 && importFrom == "" {
+		handleError(fmt.Errorf("-update-graph needs -from-graph"))
+	}
+	if importFrom != "" {
+		if clone || build || watch {
+			handleError(fmt.Errorf(
+				"-from-graph can't be used to clone or build"))
+		}
+		if len(updated) != 0 {
+			graph, err = readGraphExport(importFrom)
+			handleError(err)
+			graph, repos, err = updateGraph(graph, srcDir, updated)
+		} else {
+			repos, err = importGraph(importFrom)
+		}
+	} else {
+		repos, err = enumerateBuildableRepos(srcDir)
+	}
+	handleError(err)
+	if len(repos.optedOut) != 0 {
+		out.Event("opted_out", repos.optedOut, fmt.Sprintf(
+			"Repos opted out with %s: %s", bootstrapSkipFile,
+			repos.optedOut))
+	}
+	if countMode {
+		if importFrom != "" {
+			handleError(fmt.Errorf(
+				"-count needs the source directory"))
+		}
+		counts, err := countRepos(srcDir, repos)
+		handleError(err)
+		out.Result("repo_counts", counts, counts.String())
+		handleError(out.Close())
+		return
+	}
+	warnKernel(repos)
+	if strict {
+		handleError(checkStrict(repos, srcDir))
+	}
+	if failArchivedDeps {
+		handleError(checkArchivedDeps(ctx, srcDir, repos))
+	}
+	if strictControl {
+		if errs := controlIssues(repos); len(errs) != 0 {
+			handleError(errs)
+		}
+	}
 	buildOrder := determineBuildOrder(repos)
+	if len(priorities) != 0 {
+		for _, repo := range priorities {
+			if !contains(buildOrder, repo) {
+				fmt.Fprintln(os.Stderr, "warning:", repo,
+					"is not in the build order")
+			}
+		}
+		buildOrder = prioritizeOrder(buildOrder, repos, priorities)
+	}
 
-	fmt.Printf("Build order (%d repos): %s\n",
-		len(buildOrder), buildOrder)
+	if reverse {
+		teardown := reverseOrder(buildOrder)
+		out.Result("teardown_order", teardown,
+			formatOrder("Teardown order", teardown))
+	} else {
+		out.Result("build_order", buildOrder,
+			formatOrder("Build order", buildOrder))
+		out.Result("build_levels", buildLevels(buildOrder, repos), "")
+	}
 
-	if build {
-		err := os.MkdirAll(logDir, 0777)
+	if exportTo != "" {
+		var err error
+		switch {
+		case len(updated) != 0:
+			graph.Order = buildOrder
+			err = writeGraphExport(exportTo, graph)
+		case importFrom != "":
+			err = fmt.Errorf(
+				"-export-graph needs the source directory")
+		default:
+			err = exportGraph(exportTo, srcDir, buildOrder, repos)
+		}
 		handleError(err)
-		err = buildRepos(buildOrder, logDir, pkgDir, srcDir,
-			imageName, version, local)
+	}
+
+	if graphFile != "" {
+		order := buildOrder
+		if len(subgraph) != 0 {
+			for _, repo := range subgraph {
+				if !contains(buildOrder, repo) {
+					fmt.Fprintln(os.Stderr, "warning:", repo,
+						"is not in the build order")
+				}
+			}
+			keep := dependencyClosure(subgraph, repos)
+			if subgraphDeps {
+				for repo := range dependentClosure(subgraph,
+					repos) {
+					keep[repo] = true
+				}
+			}
+			order = filterOrder(buildOrder, keep)
+		}
+		err := emitGraph(graphFile, graphFmt, order, repos)
+		handleError(err)
+	}
+
+	if makefile != "" {
+		err := emitMakefile(makefile, buildOrder, repos)
+		handleError(err)
+	}
+
+	if runScript != "" {
+		err := emitRunScript(runScript, buildOrder, repos)
+		handleError(err)
+	}
+
+	if graphStatsMode {
+		stats := analyzeGraph(buildOrder, repos)
+		out.Result("graph_stats", stats, stats.String())
+	}
+
+	if criticalMode {
+		path := filepath.Join(logDir, timingsFile)
+		history, err := readTimings(path)
+		if err != nil {
+			handleError(fmt.Errorf("no build times: %v", err))
+		}
+		cp := findCriticalPath(buildOrder, repos, history)
+		out.Result("critical_path", cp, cp.String())
+	}
+
+	if providersOf != "" {
+		err := listProviders(repos, providersOf)
+		handleError(err)
+	}
+
+	if diffFrom != "" {
+		old, err := readOrder(diffFrom)
+		handleError(err)
+		diff := diffOrder(old, buildOrder)
+		out.Result("order_diff", diff, diff.String())
+	}
+
+	// Compared before saving so a snapshot can be diffed and
+	// replaced in one run.
+	if providesDiffFrom != "" {
+		old, err := readProvidesSnapshot(providesDiffFrom)
+		handleError(err)
+		diff := diffProvides(old, repos)
+		out.Result("provides_diff", diff, diff.String())
+	}
+
+	if providesSnapshot != "" {
+		err := writeProvidesSnapshot(providesSnapshot, repos)
+		handleError(err)
+	}
+
+	if assertOrder != "" {
+		expected, err := readOrder(assertOrder)
+		handleError(err)
+		diff := diffOrder(expected, buildOrder)
+		if !diff.unchanged() {
+			out.Result("unexpected_order", diff, diff.String())
+			handleError(fmt.Errorf(
+				"build order differs from %s", assertOrder))
+		}
+	}
+
+	if impactRepo != "" {
+		err := impact(buildOrder, repos, impactRepo)
+		handleError(err)
+	}
+
+	if dumpRepo != "" {
+		err := dumpControl(repos, dumpRepo)
+		handleError(err)
+	}
+
+	if externals != "" {
+		err := checkExternalDeps(ctx, externals, pkgDir)
+		handleError(err)
+	}
+
+	if validateDepsMode {
+		handleError(validateDeps(ctx, repos))
+	}
+
+	if build || estimateMode {
+		buildSet := buildOrder
+		if retryFrom != "" {
+			report, err := readReport(retryFrom)
+			handleError(err)
+			failed := report.failedRepos()
+			buildSet = filterOrder(buildOrder, failed)
+			for repo := range failed {
+				if !contains(buildSet, repo) {
+					fmt.Fprintln(os.Stderr, "warning:", repo,
+						"is no longer in the build order")
+				}
+			}
+			out.Event("retry", buildSet, fmt.Sprintf(
+				"Retrying %d failed repos: %s",
+				len(buildSet), buildSet))
+		}
+		if len(packages) != 0 {
+			targets, unresolved := resolvePackages(packages, repos)
+			for _, pkg := range unresolved {
+				fmt.Fprintln(os.Stderr, "warning: no repo builds",
+					"package", pkg)
+			}
+			if len(targets) == 0 {
+				handleError(fmt.Errorf(
+					"none of the requested packages are built " +
+						"by a repo in the tree"))
+			}
+			keep := dependencyClosure(targets, repos)
+			if noDeps {
+				keep = make(map[string]bool)
+				for _, repo := range targets {
+					keep[repo] = true
+				}
+			}
+			buildSet = filterOrder(buildSet, keep)
+			out.Event("packages", buildSet, fmt.Sprintf(
+				"Building %d repos for packages %s: %s",
+				len(buildSet), packages, buildSet))
+		}
+		if len(selectQueries) != 0 {
+			selected := selectRepos(repos, selectQueries)
+			if len(selected) == 0 {
+				handleError(fmt.Errorf(
+					"no repo matches %s", selectQueries.String()))
+			}
+			keep := dependencyClosure(selected, repos)
+			if noDeps {
+				keep = make(map[string]bool)
+				for _, repo := range selected {
+					keep[repo] = true
+				}
+			}
+			buildSet = filterOrder(buildSet, keep)
+			out.Event("select", buildSet, fmt.Sprintf(
+				"Building %d repos for %s: %s",
+				len(buildSet), selectQueries.String(), buildSet))
+		}
+		if changedDebian != "" {
+			changed := changedPackaging(srcDir, buildSet,
+				changedDebian)
+			keep := make(map[string]bool)
+			for _, repo := range changed {
+				keep[repo] = true
+			}
+			if withDeps {
+				keep = dependentClosure(changed, repos)
+			}
+			buildSet = filterOrder(buildSet, keep)
+			out.Event("only_changed_debian", buildSet, fmt.Sprintf(
+				"Building %d repos with packaging changed since "+
+					"%s: %s", len(buildSet), changedDebian,
+				buildSet))
+		}
+		if startAt != "" || stopAfter != "" {
+			window, err := orderWindow(buildOrder, startAt,
+				stopAfter)
+			handleError(err)
+			buildSet = filterOrder(buildSet, window)
+			out.Event("window", buildSet, fmt.Sprintf(
+				"Limited to the window of the build order "+
+					"(%d repos): %s", len(buildSet), buildSet))
+		}
+		if maxDepth > 0 {
+			buildSet = filterOrder(buildSet,
+				reposWithinDepth(buildOrder, repos, maxDepth))
+			out.Event("max_depth", buildSet, fmt.Sprintf(
+				"Limited to depth %d (%d repos): %s",
+				maxDepth, len(buildSet), buildSet))
+		}
+		if untilLevel >= 0 {
+			buildSet = filterOrder(buildSet,
+				reposUntilLevel(buildSet, repos, untilLevel))
+			out.Event("until_level", buildSet, fmt.Sprintf(
+				"Limited to levels 0-%d (%d repos): %s",
+				untilLevel, len(buildSet), buildSet))
+		}
+		if estimateMode {
+			path := filepath.Join(logDir, timingsFile)
+			history, err := readTimings(path)
+			if err != nil {
+				handleError(fmt.Errorf("no build times: %v", err))
+			}
+			est := estimateBuild(buildSet, repos, history, jobs)
+			out.Result("estimate", est, est.String())
+			handleError(out.Close())
+			return
+		}
+		if noDeps {
+			warnUnbuiltDeps(buildSet, repos, pkgDir)
+		}
+		err := runBuild(ctx, stop, buildSet, repos, uploader)
+		if !watch {
+			handleError(err)
+		}
+	}
+
+	if watch {
+		err := watchRepos(ctx, stop)
 		handleError(err)
 	}
+	closeSink()
+	handleError(out.Close())
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+
+	"pault.ag/go/debian/control"
+)
+
+// testRepos returns the metadata of repos whose control files are
+// given by repo name.
+func testRepos(t *testing.T, ctrls map[string]string) repoMetaData {
+	repos := repoMetaData{
+		ctrlFiles: make(map[string]*control.Control),
+		pack2repo: make(map[string]string),
+	}
+	for repo, text := range ctrls {
+		ctrl, err := control.ParseControl(
+			bufio.NewReader(strings.NewReader(text)), repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repos.ctrlFiles[repo] = ctrl
+		for _, bin := range ctrl.Binaries {
+			repos.pack2repo[bin.Package] = repo
+		}
+	}
+	return repos
+}
+
+func TestUntilLevelCountsBuildSetLevels(t *testing.T) {
+	repos := testRepos(t, map[string]string{
+		"a": "Source: a\n\nPackage: a-dev\nArchitecture: any\n",
+		"b": "Source: b\nBuild-Depends: a-dev\n\n" +
+			"Package: b-dev\nArchitecture: any\n",
+		"c": "Source: c\nBuild-Depends: b-dev\n\n" +
+			"Package: c\nArchitecture: any\n",
+	})
+	order := determineBuildOrder(repos)
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("order = %q, want %q", order, want)
+	}
+	// a is already built, so only b and c are being built
+	buildSet := []string{"b", "c"}
+
+	for _, test := range []struct {
+		name string
+		keep map[string]bool
+		want []string
+	}{
+		// the whole tree's levels 0 and 1 are a and b
+		{"max-depth 2", reposWithinDepth(order, repos, 2),
+			[]string{"b"}},
+		// the build set's levels 0 and 1 are b and c
+		{"until-level 1", reposUntilLevel(buildSet, repos, 1),
+			[]string{"b", "c"}},
+		{"max-depth 1", reposWithinDepth(order, repos, 1),
+			[]string{}},
+		{"until-level 0", reposUntilLevel(buildSet, repos, 0),
+			[]string{"b"}},
+	} {
+		got := filterOrder(buildSet, test.keep)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got,
+				test.want)
+		}
+	}
+}
+
+func TestDuplicateSourcesSkipsMissingSource(t *testing.T) {
+	repos := testRepos(t, map[string]string{
+		"a": "Maintainer: A <a@a>\n\nPackage: a\nArchitecture: any\n",
+		"b": "Maintainer: B <b@b>\n\nPackage: b\nArchitecture: any\n",
+		"c": "Source: c\n\nPackage: c\nArchitecture: any\n",
+		"d": "Source: c\n\nPackage: d\nArchitecture: any\n",
+	})
+	errs := repos.duplicateSources()
+	if len(errs) != 1 || errs[0].Error() !=
+		"source package c is declared by repos c, d" {
+		t.Errorf("duplicateSources() = %v", errs)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// defaultNotifyTemplate formats the message posted to -notify-url.
+const defaultNotifyTemplate = `danos-bootstrap: {{.Built}} repos built, ` +
+	`{{.Failed}} failed{{if .FailedRepos}}: {{join .FailedRepos ", "}}{{end}}`
+
+// notifyTimeout bounds how long posting to -notify-url may take.
+const notifyTimeout = 30 * time.Second
+
+// notifyData is what the -notify-template is executed with.
+type notifyData struct {
+	Built       int
+	Failed      int
+	FailedRepos []string
+	Report      buildReport
+}
+
+// notifyMessage is posted to -notify-url. Text makes it a Slack
+// compatible incoming webhook message.
+type notifyMessage struct {
+	Text   string      `json:"text"`
+	Report buildReport `json:"report"`
+}
+
+// notifyTmpl is the parsed -notify-template.
+var notifyTmpl *template.Template
+
+// parseNotifyTemplate parses the -notify-template, so a mistake in it
+// is reported before anything is built rather than once the run is
+// over.
+func parseNotifyTemplate() error {
+	tmpl, err := template.New("notify").Funcs(template.FuncMap{
+		"join": strings.Join,
+	}).Parse(notifyTemplate)
+	if err != nil {
+		return fmt.Errorf("-notify-template: %v", err)
+	}
+	notifyTmpl = tmpl
+	return nil
+}
+
+func formatNotification(report buildReport) (string, error) {
+	data := notifyData{Report: report}
+	for _, res := range report.Repos {
+		switch res.Status {
+		case statusBuilt, statusPrebuilt:
+			data.Built++
+		default:
+			data.Failed++
+			data.FailedRepos = append(data.FailedRepos, res.Repo)
+		}
+	}
+	var b strings.Builder
+	err := notifyTmpl.Execute(&b, data)
+	return b.String(), err
+}
+
+// notify posts the build report to -notify-url. A failure to notify
+// is only logged, it doesn't fail the run.
+func notify(report buildReport) {
+	err := postNotification(report)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "warning: notify failed:", err)
+	}
+}
+
+func postNotification(report buildReport) error {
+	text, err := formatNotification(report)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(notifyMessage{Text: text, Report: report})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(notifyURL, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", notifyURL, resp.Status)
+	}
+	return nil
+}
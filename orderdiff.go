@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// orderMove is a repo whose position in the build order changed
+// relative to the repos around it. Positions count from 1 among the
+// repos in both orders, so additions and removals don't shift them.
+type orderMove struct {
+	Repo string `json:"repo"`
+	From int    `json:"from"`
+	To   int    `json:"to"`
+}
+
+// orderDiff is how a build order differs from a saved one.
+type orderDiff struct {
+	Added   []string    `json:"added"`
+	Removed []string    `json:"removed"`
+	Moved   []orderMove `json:"moved"`
+}
+
+// unchanged reports whether the orders were the same.
+func (d orderDiff) unchanged() bool {
+	return len(d.Added)+len(d.Removed)+len(d.Moved) == 0
+}
+
+func (d orderDiff) String() string {
+	if d.unchanged() {
+		return "Build order is unchanged\n"
+	}
+	var b strings.Builder
+	for _, repo := range d.Added {
+		fmt.Fprintln(&b, "added:", repo)
+	}
+	for _, repo := range d.Removed {
+		fmt.Fprintln(&b, "removed:", repo)
+	}
+	for _, m := range d.Moved {
+		fmt.Fprintf(&b, "moved: %s %d -> %d\n", m.Repo, m.From, m.To)
+	}
+	return b.String()
+}
+
+// readOrder reads a saved build order. It may be a -export-graph file,
+// a -json result or a plain list of repos.
+func readOrder(path string) ([]string, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Order      []string `json:"order"`
+		BuildOrder []string `json:"build_order"`
+	}
+	if json.Unmarshal(buf, &doc) != nil {
+		return strings.Fields(string(buf)), nil
+	}
+	switch {
+	case doc.Order != nil:
+		return doc.Order, nil
+	case doc.BuildOrder != nil:
+		return doc.BuildOrder, nil
+	}
+	return nil, fmt.Errorf("%s: no build order", path)
+}
+
+// diffOrder compares order against old. Inserting or removing a repo
+// shifts every later position, so only the repos outside the longest
+// common subsequence of the two orders are reported as moved.
+func diffOrder(old, order []string) orderDiff {
+	var d orderDiff
+	oldPos := make(map[string]int)
+	for i, repo := range old {
+		oldPos[repo] = i
+	}
+	newPos := make(map[string]int)
+	for i, repo := range order {
+		newPos[repo] = i
+		if _, ok := oldPos[repo]; !ok {
+			d.Added = append(d.Added, repo)
+		}
+	}
+	var a, b []string
+	for _, repo := range old {
+		if _, ok := newPos[repo]; ok {
+			a = append(a, repo)
+		} else {
+			d.Removed = append(d.Removed, repo)
+		}
+	}
+	for _, repo := range order {
+		if _, ok := oldPos[repo]; ok {
+			b = append(b, repo)
+		}
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	kept := make(map[string]bool)
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			kept[a[i]] = true
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	from := make(map[string]int)
+	for i, repo := range a {
+		from[repo] = i + 1
+	}
+	for i, repo := range b {
+		if !kept[repo] {
+			d.Moved = append(d.Moved, orderMove{
+				Repo: repo,
+				From: from[repo],
+				To:   i + 1,
+			})
+		}
+	}
+	return d
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// outputFormat presents the progress and results of a run.
+type outputFormat interface {
+	// Event reports progress as it happens.
+	Event(name string, data interface{}, text string)
+	// Result records part of the run's result, text is its human
+	// readable form.
+	Result(key string, value interface{}, text string)
+	// Close finishes the output.
+	Close() error
+}
+
+// out is where the progress and results of the run are sent.
+var out outputFormat = textOutput{}
+
+// terminal is where build and clone output is mirrored. When stdout
+// carries a JSON document it must not be interleaved with it.
+func terminal() io.Writer {
+	if _, ok := out.(*jsonOutput); ok {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// repoTerminal is where a repo's build output is mirrored, the -quiet
+// repos only write theirs to the log.
+func repoTerminal(repo string) io.Writer {
+	if contains(quietRepos, repo) {
+		return ioutil.Discard
+	}
+	return terminal()
+}
+
+// textOutput writes human readable text to stdout.
+type textOutput struct{}
+
+func (textOutput) Event(name string, data interface{}, text string) {
+	if text != "" {
+		fmt.Println(strings.TrimSuffix(text, "\n"))
+	}
+}
+
+func (textOutput) Result(key string, value interface{}, text string) {
+	if text != "" {
+		fmt.Println(strings.TrimSuffix(text, "\n"))
+	}
+}
+
+func (textOutput) Close() error {
+	return nil
+}
+
+// jsonOutput writes events as JSON lines to stderr and the results as
+// a single JSON document to stdout when the run finishes.
+type jsonOutput struct {
+	mu     sync.Mutex
+	events *json.Encoder
+	doc    map[string]interface{}
+}
+
+func newJSONOutput() *jsonOutput {
+	return &jsonOutput{
+		events: json.NewEncoder(os.Stderr),
+		doc:    make(map[string]interface{}),
+	}
+}
+
+func (o *jsonOutput) Event(name string, data interface{}, text string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events.Encode(struct {
+		Event   string      `json:"event"`
+		Message string      `json:"message,omitempty"`
+		Data    interface{} `json:"data,omitempty"`
+	}{
+		Event:   name,
+		Message: text,
+		Data:    data,
+	})
+}
+
+func (o *jsonOutput) Result(key string, value interface{}, text string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.doc[key] = value
+}
+
+func (o *jsonOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(o.doc)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// repoPatches returns the patches in -patch-dir for repo, in the order
+// they are applied.
+func repoPatches(repo string) ([]string, error) {
+	if patchDir == "" {
+		return nil, nil
+	}
+	return filepath.Glob(filepath.Join(resolvePath(patchDir), repo,
+		"*.patch"))
+}
+
+func gitApply(dir string, args ...string) error {
+	cmd := exec.Command("git", append([]string{"apply"}, args...)...)
+	cmd.Dir = dir
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	if err != nil && out.Len() > 0 {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(out.String()))
+	}
+	return err
+}
+
+// applyPatches applies repo's patches from -patch-dir to its source in
+// dir. The returned function reverts them so the clone is left as it
+// was checked out.
+func applyPatches(dir, repo string) (func(), error) {
+	patches, err := repoPatches(repo)
+	if err != nil {
+		return nil, err
+	}
+	var applied []string
+	revert := func() {
+		for i := len(applied) - 1; i >= 0; i-- {
+			err := gitApply(dir, "-R", applied[i])
+			if err != nil {
+				fmt.Fprintf(os.Stderr,
+					"warning: reverting %s in %s: %v\n",
+					filepath.Base(applied[i]), repo, err)
+			}
+		}
+	}
+	for _, patch := range patches {
+		fmt.Println("Applying", filepath.Base(patch), "to", repo)
+		err := gitApply(dir, patch)
+		if err != nil {
+			revert()
+			return nil, fmt.Errorf("patch apply failed: %s: %v",
+				filepath.Base(patch), err)
+		}
+		applied = append(applied, patch)
+	}
+	return revert, nil
+}
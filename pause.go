@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// pauseGate holds back new builds while a run is paused.
+type pauseGate struct {
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{}
+}
+
+func newPauseGate() *pauseGate {
+	return &pauseGate{resumed: make(chan struct{})}
+}
+
+// pause stops new builds from starting, it reports whether the gate
+// was running.
+func (g *pauseGate) pause() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		return false
+	}
+	g.paused = true
+	g.resumed = make(chan struct{})
+	return true
+}
+
+// resume lets new builds start again, it reports whether the gate was
+// paused.
+func (g *pauseGate) resume() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused {
+		return false
+	}
+	g.paused = false
+	close(g.resumed)
+	return true
+}
+
+func (g *pauseGate) isPaused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// wait blocks while the gate is paused or until ctx is cancelled.
+func (g *pauseGate) wait(ctx context.Context) error {
+	g.mu.Lock()
+	paused, resumed := g.paused, g.resumed
+	g.mu.Unlock()
+	if !paused {
+		return ctx.Err()
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handlePauseSignals pauses the gate on SIGUSR1 and resumes it on
+// SIGUSR2 until ctx is cancelled. running reports how many builds are
+// in progress.
+func handlePauseSignals(ctx context.Context, g *pauseGate, running func() int) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case sig := <-signals:
+				switch {
+				case sig == syscall.SIGUSR1 && g.pause():
+					out.Event("paused", running(), fmt.Sprintf(
+						"Paused: letting %d running builds "+
+							"finish, send SIGUSR2 to resume",
+						running()))
+				case sig == syscall.SIGUSR2 && g.resume():
+					out.Event("resumed", nil, "Resumed")
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
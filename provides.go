@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// providesMapping is a package and the repo that provides it.
+type providesMapping struct {
+	Package string `json:"package"`
+	Repo    string `json:"repo"`
+}
+
+// providesMove is a package provided by a different repo than in the
+// saved map.
+type providesMove struct {
+	Package string `json:"package"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+// providesDiff is how the map of packages, and the virtual packages
+// they Provide, to the repos that build them differs from a saved one.
+type providesDiff struct {
+	Added   []providesMapping `json:"added"`
+	Removed []providesMapping `json:"removed"`
+	Moved   []providesMove    `json:"moved"`
+}
+
+// unchanged reports whether the maps were the same.
+func (d providesDiff) unchanged() bool {
+	return len(d.Added)+len(d.Removed)+len(d.Moved) == 0
+}
+
+func (d providesDiff) String() string {
+	if d.unchanged() {
+		return "Provided packages are unchanged\n"
+	}
+	var b strings.Builder
+	for _, m := range d.Added {
+		fmt.Fprintf(&b, "added: %s (%s)\n", m.Package, m.Repo)
+	}
+	for _, m := range d.Removed {
+		fmt.Fprintf(&b, "removed: %s (%s)\n", m.Package, m.Repo)
+	}
+	for _, m := range d.Moved {
+		fmt.Fprintf(&b, "moved: %s %s -> %s\n", m.Package, m.From, m.To)
+	}
+	return b.String()
+}
+
+// writeProvidesSnapshot saves the package to repo map as a JSON
+// object, indented with sorted keys so snapshots diff well in version
+// control.
+func writeProvidesSnapshot(path string, repos repoMetaData) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(repos.pack2repo)
+}
+
+func readProvidesSnapshot(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out map[string]string
+	err = json.NewDecoder(f).Decode(&out)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return out, nil
+}
+
+// diffProvides compares the package to repo map with a saved one.
+func diffProvides(old map[string]string, repos repoMetaData) providesDiff {
+	var d providesDiff
+	for pkg, repo := range repos.pack2repo {
+		oldRepo, ok := old[pkg]
+		switch {
+		case !ok:
+			d.Added = append(d.Added,
+				providesMapping{Package: pkg, Repo: repo})
+		case oldRepo != repo:
+			d.Moved = append(d.Moved,
+				providesMove{Package: pkg, From: oldRepo, To: repo})
+		}
+	}
+	for pkg, repo := range old {
+		if _, ok := repos.pack2repo[pkg]; !ok {
+			d.Removed = append(d.Removed,
+				providesMapping{Package: pkg, Repo: repo})
+		}
+	}
+	sort.Slice(d.Added, func(i, j int) bool {
+		return d.Added[i].Package < d.Added[j].Package
+	})
+	sort.Slice(d.Removed, func(i, j int) bool {
+		return d.Removed[i].Package < d.Removed[j].Package
+	})
+	sort.Slice(d.Moved, func(i, j int) bool {
+		return d.Moved[i].Package < d.Moved[j].Package
+	})
+	return d
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const clonedRefsFile = "cloned-refs.json"
+
+// clonedRefs records the commit each repo was at when it was cloned.
+type clonedRefs struct {
+	Ref      string            `json:"ref"`
+	AsOf     string            `json:"as_of,omitempty"`
+	Repos    map[string]string `json:"repos"`
+	Archived []string          `json:"archived,omitempty"`
+	// Missing are the repos that failed to clone or weren't reached.
+	Missing []string `json:"missing,omitempty"`
+	// Orgs are the organizations of the repos not cloned from
+	// danos.
+	Orgs map[string]string `json:"orgs,omitempty"`
+	// URLs are the URLs the repos were cloned from.
+	URLs map[string]string `json:"urls,omitempty"`
+	// Sources are the bundles and tarballs of the repos populated
+	// from a -sources manifest.
+	Sources map[string]string `json:"sources,omitempty"`
+}
+
+// repoCommit returns the commit checked out in a repo.
+func repoCommit(dir string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// verifyClone checks that dir holds an intact git repo of its own with
+// a commit checked out.
+func verifyClone(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		return errors.New("not a git repo")
+	}
+	for _, args := range [][]string{
+		{"rev-parse", "--verify", "-q", "HEAD^{commit}"},
+		{"fsck", "--connectivity-only", "--no-dangling", "--no-progress"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("git %s: %v %s", args[0], err,
+				strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// checkoutAsOf checks out the last commit of the checked out branch
+// that was made before the given time.
+func checkoutAsOf(dir, asOf string) error {
+	cmd := exec.Command("git", "rev-list", "-1", "--before="+asOf, "HEAD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+	sha := strings.TrimSpace(string(out))
+	if sha == "" {
+		return fmt.Errorf("no commit before %s", asOf)
+	}
+	cmd = exec.Command("git", "checkout", "-q", sha)
+	cmd.Dir = dir
+	cmd.Stdout = terminal()
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func readClonedRefs(srcDir string) (clonedRefs, error) {
+	refs := clonedRefs{Repos: make(map[string]string)}
+	f, err := os.Open(filepath.Join(srcDir, clonedRefsFile))
+	if err != nil {
+		return refs, err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&refs)
+	return refs, err
+}
+
+func writeClonedRefs(srcDir string, refs clonedRefs) error {
+	f, err := os.Create(filepath.Join(srcDir, clonedRefsFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(refs)
+}
+
+// checkDrift warns about repos that are no longer at the commit
+// recorded when they were cloned.
+func checkDrift(srcDir string, repos []string) {
+	refs, err := readClonedRefs(srcDir)
+	if err != nil {
+		// nothing was recorded for this tree
+		return
+	}
+	var drifted []string
+	for _, repo := range repos {
+		want, ok := refs.Repos[repo]
+		if !ok {
+			continue
+		}
+		have, err := repoCommit(filepath.Join(srcDir, repo))
+		if err != nil || have != want {
+			drifted = append(drifted, repo)
+		}
+	}
+	sort.Strings(drifted)
+	for _, repo := range drifted {
+		fmt.Fprintf(os.Stderr,
+			"warning: %s is no longer at the cloned commit %s\n",
+			repo, refs.Repos[repo])
+	}
+}
+
+// verifyConsistentRef warns about cloned repos that are not at the ref
+// the tree was cloned from, so a release isn't built from a mix of
+// refs. Repos cloned with -as-of only need the commit to be on the ref.
+func verifyConsistentRef(srcDir string) error {
+	refs, err := readClonedRefs(srcDir)
+	if err != nil {
+		return fmt.Errorf("no record of the cloned refs: %v", err)
+	}
+	var repos []string
+	for repo := range refs.Repos {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	for _, repo := range repos {
+		dir := filepath.Join(srcDir, repo)
+		have, err := repoCommit(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %s: %v\n", repo, err)
+			continue
+		}
+		cmd := exec.Command("git", "rev-parse", "--verify", "-q",
+			refs.Ref+"^{commit}")
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %s has no ref %s\n",
+				repo, refs.Ref)
+			continue
+		}
+		want := strings.TrimSpace(string(out))
+		if refs.AsOf != "" {
+			cmd = exec.Command("git", "merge-base", "--is-ancestor",
+				have, want)
+			cmd.Dir = dir
+			if cmd.Run() != nil {
+				fmt.Fprintf(os.Stderr,
+					"warning: %s is at %s which is not on %s\n",
+					repo, have, refs.Ref)
+			}
+			continue
+		}
+		if have != want {
+			fmt.Fprintf(os.Stderr,
+				"warning: %s is at %s not %s (%s)\n",
+				repo, have, refs.Ref, want)
+		}
+	}
+	return nil
+}
+
+// checkComplete fails if any repo expected in srcDir is missing from
+// it. The expected repos are the ones recorded when srcDir was cloned,
+// or every unarchived repo in the organization if it wasn't.
+func checkComplete(ctx context.Context, srcDir string) error {
+	var expected []string
+	refs, err := readClonedRefs(srcDir)
+	if err == nil {
+		for repo := range refs.Repos {
+			expected = append(expected, repo)
+		}
+		expected = append(expected, refs.Missing...)
+	} else {
+		repos, err := listOrgRepos(ctx)
+		if err != nil {
+			return err
+		}
+		for _, repo := range repos {
+			if repo.Archived == nil || !*repo.Archived {
+				expected = append(expected, *repo.Name)
+			}
+		}
+	}
+	var missing []string
+	for _, repo := range expected {
+		_, err := os.Stat(sourceDir(srcDir, repo))
+		if err != nil {
+			missing = append(missing, repo)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return fmt.Errorf("%d repos are missing from %s: %s",
+		len(missing), srcDir, strings.Join(missing, ", "))
+}
+
+// checkArchivedDeps fails if a repo build depends on an archived repo,
+// which will break once the repo's packages are gone from the
+// archive. The archived repos are the ones recorded when srcDir was
+// cloned, or listed as archived in the organization if it wasn't.
+func checkArchivedDeps(ctx context.Context, srcDir string, repos repoMetaData) error {
+	archived := make(map[string]bool)
+	refs, err := readClonedRefs(srcDir)
+	if err == nil {
+		for _, repo := range refs.Archived {
+			archived[repo] = true
+		}
+	} else {
+		listed, err := listOrgRepos(ctx)
+		if err != nil {
+			return err
+		}
+		for _, repo := range listed {
+			if repo.Archived != nil && *repo.Archived {
+				archived[*repo.Name] = true
+			}
+		}
+	}
+	errs := archivedDependencies(repos, archived)
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// changedPackaging returns the repos whose debian directory changed
+// between ref and HEAD. Repos that can't be compared, such as ones
+// without ref, are included with a warning.
+func changedPackaging(srcDir string, repos []string, ref string) []string {
+	var changed []string
+	for _, repo := range repos {
+		cmd := exec.Command("git", "diff", "--quiet", ref+"..HEAD",
+			"--", "debian/")
+		cmd.Dir = packagingDir(srcDir, repo)
+		err := cmd.Run()
+		if err == nil {
+			continue
+		}
+		if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() != 1 {
+			fmt.Fprintf(os.Stderr,
+				"warning: can't compare %s with %s: %v\n",
+				repo, ref, err)
+		}
+		changed = append(changed, repo)
+	}
+	return changed
+}
+
+// cleanSource removes the untracked and ignored files a previous build
+// left in a repo. Only clones recorded in the cloned refs are cleaned,
+// a repo from the -overlay directory or one that was put in the source
+// directory by hand may hold work that isn't committed.
+func cleanSource(srcDir, repo string) error {
+	dir := sourceDir(srcDir, repo)
+	if dir != filepath.Join(srcDir, repo) {
+		return nil
+	}
+	refs, err := readClonedRefs(srcDir)
+	if err != nil {
+		return nil
+	}
+	if _, ok := refs.Repos[repo]; !ok {
+		return nil
+	}
+	cmd := exec.Command("git", "clean", "-fdxq")
+	cmd.Dir = dir
+	cmd.Stdout = terminal()
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("cleaning the source failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"pault.ag/go/debian/changelog"
+)
+
+const (
+	statusBuilt    = "built"
+	statusPrebuilt = "prebuilt"
+	statusFailed   = "failed"
+	// statusOOMKilled builds exceeded their memory limit
+	statusOOMKilled = "oom-killed"
+	// statusAllowedFailure repos failed but were listed in
+	// -allow-failure
+	statusAllowedFailure = "allowed-failure"
+	// statusSkipped repos weren't built as a dependency was an
+	// allowed failure or the -deadline was reached
+	statusSkipped = "skipped"
+	// statusTestFailed repos built but failed the -test-hook
+	statusTestFailed = "test-failed"
+	statusPassed     = "passed"
+)
+
+// repoResult records the outcome of building a single repo.
+type repoResult struct {
+	Repo   string `json:"repo"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Commit string `json:"commit,omitempty"`
+	// Version is the top entry of the repo's debian/changelog, the
+	// version of the packages it builds
+	Version string `json:"version,omitempty"`
+	Test    string `json:"test,omitempty"`
+	// Duration of the build in seconds
+	Duration float64 `json:"duration"`
+
+	Lintian *lintianCounts `json:"lintian,omitempty"`
+	// LogTail is the end of a failed build's log
+	LogTail []string `json:"log_tail,omitempty"`
+}
+
+// changelogVersion returns the version of the top entry of the
+// debian/changelog in repoPath, empty if it can't be read.
+func changelogVersion(repoPath string) string {
+	entry, err := changelog.ParseFileOne(
+		filepath.Join(repoPath, "debian", "changelog"))
+	if err != nil {
+		return ""
+	}
+	return entry.Version.String()
+}
+
+// packageSummary describes the packages present in the package
+// directory after a build.
+type packageSummary struct {
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+	Repos int   `json:"repos"`
+}
+
+func (s packageSummary) String() string {
+	return fmt.Sprintf("Built %d .deb packages totaling %s across %d repos.",
+		s.Count, formatBytes(s.Bytes), s.Repos)
+}
+
+// buildReport is the machine readable record of a build run, written
+// to the log directory when the run completes.
+type buildReport struct {
+	Repos           []repoResult     `json:"repos"`
+	Packages        packageSummary   `json:"packages"`
+	InstallFailures []installFailure `json:"install_failures,omitempty"`
+	Uploads         []uploadResult   `json:"uploads,omitempty"`
+}
+
+func summarizePackages(debDir string, results []repoResult) (packageSummary, error) {
+	var out packageSummary
+	for _, res := range results {
+		switch res.Status {
+		case statusBuilt, statusPrebuilt, statusTestFailed:
+			out.Repos++
+		}
+	}
+	debs := globPackages(debDir, "*.deb")
+	for _, deb := range debs {
+		info, err := os.Stat(deb)
+		if err != nil {
+			return out, err
+		}
+		out.Count++
+		out.Bytes += info.Size()
+	}
+	return out, nil
+}
+
+// lintianSummary lists the repos whose builds reported lintian
+// issues.
+func lintianSummary(results []repoResult) string {
+	var b strings.Builder
+	for _, res := range results {
+		lint := res.Lintian
+		if lint == nil || lint.Errors+lint.Warnings == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "lintian: %s: %d errors, %d warnings\n",
+			res.Repo, lint.Errors, lint.Warnings)
+	}
+	return b.String()
+}
+
+// oomSummary lists the repos whose builds were OOM-killed.
+func oomSummary(results []repoResult) string {
+	var b strings.Builder
+	for _, res := range results {
+		if res.Status == statusOOMKilled {
+			fmt.Fprintln(&b, "oom-killed:", res.Repo)
+		}
+	}
+	return b.String()
+}
+
+// logTail returns the last n lines of a log, keeping only those in a
+// ring buffer as the log is read.
+func logTail(path string, n int) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ring := make([]string, n)
+	count := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		ring[count%n] = scanner.Text()
+		count++
+	}
+	if count <= n {
+		return ring[:count], scanner.Err()
+	}
+	start := count % n
+	return append(ring[start:], ring[:start]...), scanner.Err()
+}
+
+// tailSummary prints the log tails of the failed builds.
+func tailSummary(results []repoResult) string {
+	var b strings.Builder
+	for _, res := range results {
+		if len(res.LogTail) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "==> %s.log <==\n", res.Repo)
+		for _, line := range res.LogTail {
+			fmt.Fprintln(&b, line)
+		}
+	}
+	return b.String()
+}
+
+// allowedSummary lists the -allow-failure repos that failed and the
+// repos that were skipped because of them.
+func allowedSummary(results []repoResult) string {
+	var b strings.Builder
+	for _, res := range results {
+		switch res.Status {
+		case statusAllowedFailure:
+			fmt.Fprintln(&b, "allowed failure:", res.Repo)
+		case statusSkipped:
+			fmt.Fprintf(&b, "skipped: %s, %s\n", res.Repo, res.Error)
+		}
+	}
+	return b.String()
+}
+
+// testSummary summarizes the -test-hook results.
+func testSummary(results []repoResult) string {
+	var passed, failed []string
+	for _, res := range results {
+		switch res.Test {
+		case statusPassed:
+			passed = append(passed, res.Repo)
+		case statusFailed:
+			failed = append(failed, res.Repo)
+		}
+	}
+	if len(passed)+len(failed) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Tests: %d passed, %d failed\n", len(passed), len(failed))
+	for _, repo := range failed {
+		fmt.Fprintln(&b, "test failed:", repo)
+	}
+	return b.String()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func readReport(path string) (buildReport, error) {
+	var report buildReport
+	f, err := os.Open(path)
+	if err != nil {
+		return report, err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&report)
+	if err != nil {
+		return report, fmt.Errorf("%s: %s", path, err)
+	}
+	return report, nil
+}
+
+// failedRepos returns the set of repos that failed in a report.
+func (r buildReport) failedRepos() map[string]bool {
+	out := make(map[string]bool)
+	for _, res := range r.Repos {
+		switch res.Status {
+		case statusFailed, statusOOMKilled, statusAllowedFailure,
+			statusSkipped:
+			out[res.Repo] = true
+		}
+	}
+	return out
+}
+
+func writeReport(logDir string, report buildReport) error {
+	f, err := os.Create(filepath.Join(logDir, "build-report.json"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+const logsIndexFile = "logs-index.json"
+
+// logEntry locates the build log of a repo.
+type logEntry struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// writeLogsIndex maps each repo built in the run to its log so tools
+// can find the logs without knowing how they are named.
+func writeLogsIndex(logDir string, results []repoResult) error {
+	index := make(map[string]logEntry)
+	for _, res := range results {
+		if res.Status == statusSkipped {
+			continue
+		}
+		path := resolvePath(filepath.Join(logDir, res.Repo+".log"))
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		index[res.Repo] = logEntry{
+			Path:   path,
+			Status: res.Status,
+			Bytes:  info.Size(),
+		}
+	}
+	f, err := os.Create(filepath.Join(logDir, logsIndexFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(index)
+}
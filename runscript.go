@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// shellQuote quotes s as a single word for the shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// runScriptBuild is the body of the run script's build function for
+// the -builder, building the repo named by $1 from its packaging in
+// $2.
+func runScriptBuild() string {
+	if builderName == "sbuild" {
+		args := []string{
+			"--dist=" + shellQuote(sbuildDist),
+			`--build-dir="$PKG"`,
+			"--nolog",
+		}
+		if arch != "" {
+			args = append(args, "--arch="+shellQuote(arch))
+		}
+		args = append(args, `--extra-package="$PKG"`, `"$2"`)
+		return fmt.Sprintf("\t(cd \"$2\" && sbuild %s)\n",
+			strings.Join(args, " "))
+	}
+	return fmt.Sprintf("\tdocker run --rm -v \"$2:/mnt/src\" "+
+		"-v \"$PKG:/mnt/output\" -v \"$PKG:/mnt/pkgs\" %s\n",
+		shellQuote(imageRef()))
+}
+
+// writeRunScript writes a bash script that reproduces the run without
+// this tool: it clones each repo from where it was cloned, at the
+// commit recorded for it, and builds the repos in order from their
+// packaging directories. Repos taken from the -overlay are built from
+// there.
+func writeRunScript(w io.Writer, order []string, repos repoMetaData) error {
+	refs, _ := readClonedRefs(srcDir)
+
+	var b strings.Builder
+	fmt.Fprintln(&b, "#!/bin/bash")
+	fmt.Fprintln(&b, "# Generated by danos-bootstrap, do not edit.")
+	fmt.Fprintln(&b, "set -euo pipefail")
+	fmt.Fprintln(&b)
+	fmt.Fprintf(&b, "SRC=${SRC:-%s}\n", shellQuote(resolvePath(srcDir)))
+	fmt.Fprintf(&b, "PKG=${PKG:-%s}\n", shellQuote(resolvePath(pkgDir)))
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "clone() {")
+	fmt.Fprintln(&b, "\tif [ ! -d \"$SRC/$1\" ]; then")
+	fmt.Fprintln(&b, "\t\tgit clone \"$3\" \"$SRC/$1\"")
+	fmt.Fprintln(&b, "\tfi")
+	fmt.Fprintln(&b, "\tgit -C \"$SRC/$1\" checkout -q \"$2\"")
+	fmt.Fprintln(&b, "}")
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "build() {")
+	fmt.Fprintln(&b, "\techo \"Building $1\"")
+	b.WriteString(runScriptBuild())
+	fmt.Fprintln(&b, "}")
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "mkdir -p \"$SRC\" \"$PKG\"")
+	fmt.Fprintln(&b)
+	for _, repo := range order {
+		if overlaid(repo) {
+			fmt.Fprintf(&b, "# %s: built from the -overlay\n", repo)
+			continue
+		}
+		commit, ok := refs.Repos[repo]
+		if !ok {
+			var err error
+			commit, err = repoCommit(sourceDir(srcDir, repo))
+			if err != nil {
+				commit = refs.Ref
+			}
+			if commit == "" {
+				commit = gitRef
+			}
+		}
+		if commit == "" {
+			fmt.Fprintln(os.Stderr, "warning: no commit is known for",
+				repo+", the run script uses its checkout as is")
+			fmt.Fprintf(&b, "# %s: no known commit\n", repo)
+			continue
+		}
+		fmt.Fprintf(&b, "clone %s %s %s\n", repo, shellQuote(commit),
+			shellQuote(cloneURL(refs, repo)))
+	}
+	fmt.Fprintln(&b)
+	for _, repo := range order {
+		fmt.Fprintf(&b, "build %s %s\n", repo, runScriptDir(repo))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// overlaid reports whether a repo is built from its -overlay copy.
+func overlaid(repo string) bool {
+	return sourceDir(srcDir, repo) != filepath.Join(srcDir, repo)
+}
+
+// cloneURL returns the URL a repo was cloned from. Clones made before
+// the URLs were recorded use their origin remote, or else the
+// organization they were cloned from on github.com.
+func cloneURL(refs clonedRefs, repo string) string {
+	if url, ok := refs.URLs[repo]; ok {
+		return url
+	}
+	cmd := exec.Command("git", "remote", "get-url", "origin")
+	cmd.Dir = sourceDir(srcDir, repo)
+	if out, err := cmd.Output(); err == nil {
+		return strings.TrimSpace(string(out))
+	}
+	org, ok := refs.Orgs[repo]
+	if !ok {
+		org = "danos"
+	}
+	return "https://github.com/" + org + "/" + repo + ".git"
+}
+
+// runScriptDir returns the shell word for a repo's packaging directory
+// in the run script, within its clone under $SRC unless it comes from
+// the -overlay.
+func runScriptDir(repo string) string {
+	dir := packagingDir(srcDir, repo)
+	if overlaid(repo) {
+		return shellQuote(resolvePath(dir))
+	}
+	rel, err := filepath.Rel(srcDir, dir)
+	if err != nil {
+		rel = repo
+	}
+	return `"$SRC"/` + shellQuote(rel)
+}
+
+func emitRunScript(path string, order []string, repos repoMetaData) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeRunScript(f, order, repos)
+}
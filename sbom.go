@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// consumedPackage is a DANOS package that was available to a repo's
+// build to satisfy one of its build dependencies.
+type consumedPackage struct {
+	Package string `json:"package"`
+	Repo    string `json:"repo"`
+	Version string `json:"version,omitempty"`
+	File    string `json:"file,omitempty"`
+}
+
+// repoSBOM records the DANOS inputs of a repo's build.
+type repoSBOM struct {
+	Repo     string            `json:"repo"`
+	Consumed []consumedPackage `json:"consumed"`
+}
+
+// debVersion extracts the version from a name_version_arch.deb file
+// name.
+func debVersion(file string) string {
+	fields := strings.Split(strings.TrimSuffix(filepath.Base(file),
+		".deb"), "_")
+	if len(fields) != 3 {
+		return ""
+	}
+	return strings.Replace(fields[1], "%3a", ":", 1)
+}
+
+// consumedPackages resolves repo's build dependencies that come from
+// DANOS repos against the packages currently in debDir.
+func consumedPackages(repo string, repos repoMetaData, debDir string) []consumedPackage {
+	out := []consumedPackage{}
+	ctrl, ok := repos.ctrlFiles[repo]
+	if !ok {
+		return out
+	}
+	seen := make(map[string]bool)
+	for _, rel := range ctrl.Source.BuildDepends.Relations {
+		for _, pos := range rel.Possibilities {
+			name := packageName(pos.Name)
+			drepo, ok := repos.pack2repo[name]
+			if !ok || seen[name] {
+				continue
+			}
+			seen[name] = true
+			debs := globPackages(debDir, name+"_*.deb")
+			if len(debs) == 0 {
+				// Virtual packages and packages that
+				// have not been built yet have no file
+				out = append(out, consumedPackage{
+					Package: name,
+					Repo:    drepo,
+				})
+				continue
+			}
+			sort.Strings(debs)
+			for _, deb := range debs {
+				out = append(out, consumedPackage{
+					Package: name,
+					Repo:    drepo,
+					Version: debVersion(deb),
+					File:    filepath.Base(deb),
+				})
+			}
+		}
+	}
+	return out
+}
+
+func writeSBOM(logDir string, sbom repoSBOM) error {
+	f, err := os.Create(filepath.Join(logDir, sbom.Repo+".sbom.json"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sbom)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"pault.ag/go/debian/control"
+)
+
+// fieldQuery selects repos whose control file has a field matching a
+// shell pattern, such as Section=net or Maintainer=*someone*.
+type fieldQuery struct {
+	field   string
+	pattern string
+}
+
+// fieldQueries are the -select queries, a repo must match all of
+// them.
+type fieldQueries []fieldQuery
+
+func (q *fieldQueries) String() string {
+	var out []string
+	for _, query := range *q {
+		out = append(out, query.field+"="+query.pattern)
+	}
+	return strings.Join(out, " ")
+}
+
+func (q *fieldQueries) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("expected field=pattern, got %q", s)
+	}
+	if _, err := path.Match(kv[1], ""); err != nil {
+		return fmt.Errorf("bad pattern %q: %v", kv[1], err)
+	}
+	*q = append(*q, fieldQuery{field: kv[0], pattern: kv[1]})
+	return nil
+}
+
+// matchParagraph reports whether the field of a control stanza
+// matches the query. Field names are case insensitive as in Debian.
+func (q fieldQuery) matchParagraph(p control.Paragraph) bool {
+	for field, value := range p.Values {
+		if !strings.EqualFold(field, q.field) {
+			continue
+		}
+		ok, _ := path.Match(q.pattern, strings.TrimSpace(value))
+		return ok
+	}
+	return false
+}
+
+// match reports whether the source stanza or any binary stanza of a
+// control file matches the query, fields like Section may be in
+// either.
+func (q fieldQuery) match(ctrl *control.Control) bool {
+	if q.matchParagraph(ctrl.Source.Paragraph) {
+		return true
+	}
+	for _, bin := range ctrl.Binaries {
+		if q.matchParagraph(bin.Paragraph) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectRepos returns the parsed repos whose control files match all
+// the queries.
+func selectRepos(repos repoMetaData, queries fieldQueries) []string {
+	var out []string
+	for repo, ctrl := range repos.ctrlFiles {
+		matched := true
+		for _, q := range queries {
+			if !q.match(ctrl) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			out = append(out, repo)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
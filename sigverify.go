@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// debSignatureMember is the ar member dpkg-sig adds to a signed .deb.
+const debSignatureMember = "_gpgbuilder"
+
+// arMember is a file in an ar archive along with its digests.
+type arMember struct {
+	size int64
+	md5  string
+	sha1 string
+	data []byte
+}
+
+// readArMembers reads the members of the ar archive at path. Only the
+// signature member's contents are kept, the others are only hashed.
+func readArMembers(path string) (map[string]arMember, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(r, magic); err != nil ||
+		string(magic) != "!<arch>\n" {
+		return nil, errors.New("not a .deb")
+	}
+	members := make(map[string]arMember)
+	header := make([]byte, 60)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(
+			strings.TrimSpace(string(header[:16])), "/")
+		size, err := strconv.ParseInt(
+			strings.TrimSpace(string(header[48:58])), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad ar header for %s", name)
+		}
+		m := arMember{size: size}
+		md5sum, sha1sum := md5.New(), sha1.New()
+		w := io.MultiWriter(md5sum, sha1sum)
+		var buf bytes.Buffer
+		if name == debSignatureMember {
+			w = &buf
+		}
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return nil, err
+		}
+		m.md5 = hex.EncodeToString(md5sum.Sum(nil))
+		m.sha1 = hex.EncodeToString(sha1sum.Sum(nil))
+		m.data = buf.Bytes()
+		members[name] = m
+		if size%2 == 1 {
+			// members are aligned to even offsets
+			r.Discard(1)
+		}
+	}
+}
+
+// verifyDebSignature checks the dpkg-sig signature of a .deb against
+// keyring: the signature must be made by a key in the keyring and the
+// digests it signs must match the package's contents.
+func verifyDebSignature(path, keyring string) error {
+	members, err := readArMembers(path)
+	if err != nil {
+		return err
+	}
+	sig, ok := members[debSignatureMember]
+	if !ok {
+		return errors.New("unsigned")
+	}
+	cmd := exec.Command("gpgv", "--keyring", keyring, "--output", "-")
+	cmd.Stdin = bytes.NewReader(sig.data)
+	var signed, stderr bytes.Buffer
+	cmd.Stdout = &signed
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("invalid signature: %s",
+			strings.TrimSpace(stderr.String()))
+	}
+
+	// The signed text lists "md5 sha1 size name" for each member
+	// after a "Files:" line.
+	listed := make(map[string]bool)
+	inFiles := false
+	for _, line := range strings.Split(signed.String(), "\n") {
+		if strings.HasPrefix(line, "Files:") {
+			inFiles = true
+			continue
+		}
+		if !inFiles {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			break
+		}
+		name := fields[3]
+		m, ok := members[name]
+		if !ok || m.md5 != fields[0] || m.sha1 != fields[1] ||
+			strconv.FormatInt(m.size, 10) != fields[2] {
+			return fmt.Errorf("%s doesn't match its signature", name)
+		}
+		listed[name] = true
+	}
+	for name := range members {
+		if name != debSignatureMember && !listed[name] {
+			return fmt.Errorf("%s isn't signed", name)
+		}
+	}
+	return nil
+}
+
+// verifiedDebs caches the packages whose signatures were verified,
+// keyed by path, so unchanged packages aren't verified for every
+// build.
+var verifiedDebs = struct {
+	sync.Mutex
+	modTimes map[string]time.Time
+}{modTimes: make(map[string]time.Time)}
+
+// builtRepos records the repos built by this run, their packages
+// are unsigned so they are trusted without verifying them.
+var builtRepos = struct {
+	sync.Mutex
+	repos map[string]bool
+}{repos: make(map[string]bool)}
+
+func recordBuilt(repo string) {
+	builtRepos.Lock()
+	defer builtRepos.Unlock()
+	builtRepos.repos[repo] = true
+}
+
+func builtInRun(repo string) bool {
+	builtRepos.Lock()
+	defer builtRepos.Unlock()
+	return builtRepos.repos[repo]
+}
+
+// verifyDepSignatures verifies the signatures of the packages in
+// debDir a build consumes, other than those built by this run.
+func verifyDepSignatures(debDir string, inputs []consumedPackage, keyring string) error {
+	var debs []string
+	for _, input := range inputs {
+		if input.File == "" || builtInRun(input.Repo) {
+			continue
+		}
+		debs = append(debs, globPackages(debDir, input.File)...)
+	}
+	verifiedDebs.Lock()
+	defer verifiedDebs.Unlock()
+	for _, deb := range debs {
+		info, err := os.Stat(deb)
+		if err != nil {
+			return err
+		}
+		if t, ok := verifiedDebs.modTimes[deb]; ok &&
+			t.Equal(info.ModTime()) {
+			continue
+		}
+		err = verifyDebSignature(deb, keyring)
+		if err != nil {
+			return fmt.Errorf("signature verification failed "+
+				"for %s: %v", deb, err)
+		}
+		verifiedDebs.modTimes[deb] = info.ModTime()
+	}
+	return nil
+}
+
+// verifyBuildOneDeps verifies the dependencies of a -build-one build.
+// The repos it is run for are built by the same Makefile or script,
+// so only the packages of -prebuilt repos are verified.
+func verifyBuildOneDeps(debDir, baseDir, repo string) error {
+	repos, err := enumerateBuildableRepos(baseDir)
+	if err != nil {
+		return err
+	}
+	for r := range repos.ctrlFiles {
+		if _, ok := prebuilt[r]; !ok {
+			recordBuilt(r)
+		}
+	}
+	err = verifyDepSignatures(debDir,
+		consumedPackages(repo, repos, debDir), resolvePath(sigKeyring))
+	if err != nil {
+		return buildError{repo: repo, err: err}
+	}
+	return nil
+}
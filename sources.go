@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// sourceProvider populates a repo's directory in the source directory
+// from somewhere other than a GitHub clone.
+type sourceProvider interface {
+	// fetch creates dir holding the repo's source.
+	fetch(ctx context.Context, dir string) error
+	// commit is the commit of the fetched source, if it has one.
+	commit(dir string) string
+}
+
+// bundleSource clones a repo from a git bundle, checking out -ref if
+// given and the bundle's HEAD otherwise.
+type bundleSource struct {
+	path string
+}
+
+func (s bundleSource) fetch(ctx context.Context, dir string) error {
+	err := runCloneCommand(ctx, filepath.Dir(dir),
+		"clone", s.path, filepath.Base(dir))
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if gitRef != "" {
+		err = runCloneCommand(ctx, dir, "checkout", gitRef)
+		if err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+	return nil
+}
+
+func (s bundleSource) commit(dir string) string {
+	sha, _ := repoCommit(dir)
+	return sha
+}
+
+// tarballSource unpacks a source tarball in any compression tar
+// detects. A tarball holding a single top level directory, as
+// release tarballs do, has that directory's contents used as the
+// source.
+type tarballSource struct {
+	path string
+}
+
+func (s tarballSource) fetch(ctx context.Context, dir string) error {
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), ".unpack-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	cmd := exec.CommandContext(ctx, "tar", "-xf", s.path, "-C", tmp)
+	cmd.Stdout = terminal()
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return err
+	}
+	root := tmp
+	entries, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		root = filepath.Join(tmp, entries[0].Name())
+	}
+	return os.Rename(root, dir)
+}
+
+func (tarballSource) commit(string) string {
+	return ""
+}
+
+// sourceEntry is a repo listed in a -sources manifest.
+type sourceEntry struct {
+	repo     string
+	location string
+	provider sourceProvider
+}
+
+// readSourceManifest reads a -sources manifest. Each line names a repo,
+// the kind of source, bundle or tarball, and its path. Relative paths
+// are relative to the manifest.
+func readSourceManifest(path string) ([]sourceEntry, error) {
+	lines, err := readListFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var out []sourceEntry
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s: bad source %q", path, line)
+		}
+		loc := fields[2]
+		if !filepath.IsAbs(loc) {
+			loc = filepath.Join(filepath.Dir(path), loc)
+		}
+		loc = resolvePath(loc)
+		entry := sourceEntry{repo: fields[0], location: loc}
+		switch fields[1] {
+		case "bundle":
+			entry.provider = bundleSource{path: loc}
+		case "tarball":
+			entry.provider = tarballSource{path: loc}
+		default:
+			return nil, fmt.Errorf("%s: unknown source kind %q",
+				path, fields[1])
+		}
+		out = append(out, entry)
+	}
+	return out, nil
+}
+
+// prepareSources populates the source directory with the repos in a
+// -sources manifest, recording them in the cloned refs alongside any
+// cloned repos. Like a clone, a repo that is already present is an
+// error rather than being replaced.
+func prepareSources(ctx context.Context, into, manifest string) error {
+	entries, err := readSourceManifest(manifest)
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(into, 0777)
+	refs, err := readClonedRefs(into)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if refs.Ref == "" {
+		refs.Ref = gitRef
+	}
+	if refs.Sources == nil {
+		refs.Sources = make(map[string]string)
+	}
+	var errs errCollector
+	for i, entry := range entries {
+		if ctx.Err() != nil {
+			errs.add(ctx.Err())
+			for _, entry := range entries[i:] {
+				refs.Missing = append(refs.Missing, entry.repo)
+			}
+			break
+		}
+		dir := filepath.Join(into, entry.repo)
+		if _, err := os.Stat(dir); err == nil {
+			errs.add(cloneError{repo: entry.repo,
+				err: fmt.Errorf("%s already exists", dir)})
+			continue
+		}
+		err := entry.provider.fetch(ctx, dir)
+		if err != nil {
+			refs.Missing = append(refs.Missing, entry.repo)
+			err = cloneError{repo: entry.repo, err: err}
+			errs.add(err)
+			fmt.Fprintln(os.Stderr, "source", err)
+			continue
+		}
+		if sha := entry.provider.commit(dir); sha != "" {
+			refs.Repos[entry.repo] = sha
+		}
+		refs.Sources[entry.repo] = entry.location
+	}
+	err = writeClonedRefs(into, refs)
+	if err != nil {
+		errs.add(err)
+	}
+	return errs.err()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// stagingFor returns the directory a repo is built into under
+// -staging-dir, each repo has its own so parallel builds don't see
+// each other's output.
+func stagingFor(repo string) string {
+	return filepath.Join(stagingDir, repo)
+}
+
+// publishStaged moves the files a build wrote to stage into destDir.
+// Each file is renamed into place so consumers of destDir never see
+// a partly written package, files are copied next to their
+// destination first when stage is on another filesystem.
+func publishStaged(stage, destDir string) error {
+	err := os.MkdirAll(destDir, 0777)
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(stage)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		from := filepath.Join(stage, entry.Name())
+		to := filepath.Join(destDir, entry.Name())
+		if os.Rename(from, to) == nil {
+			continue
+		}
+		tmp := filepath.Join(destDir, "."+entry.Name()+".staged")
+		err := copyFile(from, tmp)
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		err = os.Rename(tmp, to)
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	return nil
+}
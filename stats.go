@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// repoDegree is the number of DANOS repos a repo declares a build
+// dependency on and the number that declare one on it.
+type repoDegree struct {
+	Repo         string `json:"repo"`
+	Dependencies int    `json:"dependencies"`
+	Dependents   int    `json:"dependents"`
+	// TransitiveDependents counts every repo that has to be built
+	// after this one.
+	TransitiveDependents int `json:"transitive_dependents"`
+}
+
+// graphStats classifies the repos by their place in the dependency
+// graph.
+type graphStats struct {
+	// Leaves are the repos nothing in the tree build-depends on.
+	Leaves []string `json:"leaves"`
+	// Roots are the repos that build-depend on nothing in the tree.
+	Roots []string `json:"roots"`
+	// MostDependedOn are the repos with the most transitive
+	// dependents, most first.
+	MostDependedOn []repoDegree `json:"most_depended_on"`
+}
+
+// mostDependedOnCount is how many repos graphStats.MostDependedOn
+// holds.
+const mostDependedOnCount = 10
+
+func (s graphStats) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Leaves (%d repos): %s\n", len(s.Leaves), s.Leaves)
+	fmt.Fprintf(&b, "Roots (%d repos): %s\n", len(s.Roots), s.Roots)
+	fmt.Fprintln(&b, "Most depended on:")
+	for _, d := range s.MostDependedOn {
+		fmt.Fprintf(&b, "  %s: %d dependents, %d transitive\n",
+			d.Repo, d.Dependents, d.TransitiveDependents)
+	}
+	return b.String()
+}
+
+// analyzeGraph computes the graph statistics of the repos in order.
+// Leaves and roots take every edge into account but the degrees only
+// count declared build dependencies, the synthetic ones on the base
+// repos would make them dominate every ranking.
+func analyzeGraph(order []string, repos repoMetaData) graphStats {
+	deps := repoDependencies(repos)
+	real := make(map[string][]string)
+	rdeps := make(map[string][]string)
+	depended := make(map[string]bool)
+	for repo, ds := range deps {
+		for _, dep := range ds {
+			depended[dep.repo] = true
+			if dep.synthetic {
+				continue
+			}
+			real[repo] = append(real[repo], dep.repo)
+			rdeps[dep.repo] = append(rdeps[dep.repo], repo)
+		}
+	}
+	var transitive func(repo string, seen map[string]bool)
+	transitive = func(repo string, seen map[string]bool) {
+		for _, rdep := range rdeps[repo] {
+			if !seen[rdep] {
+				seen[rdep] = true
+				transitive(rdep, seen)
+			}
+		}
+	}
+
+	stats := graphStats{Leaves: []string{}, Roots: []string{}}
+	var degrees []repoDegree
+	for _, repo := range order {
+		if _, ok := deps[repo]; !ok {
+			// unparseable repos have no known edges
+			continue
+		}
+		seen := make(map[string]bool)
+		transitive(repo, seen)
+		d := repoDegree{
+			Repo:                 repo,
+			Dependencies:         len(real[repo]),
+			Dependents:           len(rdeps[repo]),
+			TransitiveDependents: len(seen),
+		}
+		if !depended[repo] {
+			stats.Leaves = append(stats.Leaves, repo)
+		}
+		if len(deps[repo]) == 0 {
+			stats.Roots = append(stats.Roots, repo)
+		}
+		if d.TransitiveDependents > 0 {
+			degrees = append(degrees, d)
+		}
+	}
+	sort.SliceStable(degrees, func(i, j int) bool {
+		return degrees[i].TransitiveDependents >
+			degrees[j].TransitiveDependents
+	})
+	if len(degrees) > mostDependedOnCount {
+		degrees = degrees[:mostDependedOnCount]
+	}
+	stats.MostDependedOn = append([]repoDegree{}, degrees...)
+	return stats
+}
+
+// pathStep is a repo on the critical path, its historical build time
+// and the time until it is built in seconds.
+type pathStep struct {
+	Repo       string  `json:"repo"`
+	Duration   float64 `json:"duration"`
+	Cumulative float64 `json:"cumulative"`
+}
+
+// criticalPath is the chain of dependencies that takes longest to
+// build, the least time a build can take however many jobs it has.
+type criticalPath struct {
+	Steps []pathStep `json:"steps"`
+	Total float64    `json:"total"`
+}
+
+func (p criticalPath) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Critical path (%d repos, %s):\n", len(p.Steps),
+		seconds(p.Total))
+	for _, step := range p.Steps {
+		fmt.Fprintf(&b, "  %s: %s, %s total\n", step.Repo,
+			seconds(step.Duration), seconds(step.Cumulative))
+	}
+	return b.String()
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(time.Second)
+}
+
+// findCriticalPath computes the critical path through the repos in
+// order, weighting each repo by its build time in history. Repos
+// without history are assumed to take the median time. Unparseable
+// repos are built after everything else so they depend on every
+// parsed repo.
+func findCriticalPath(order []string, repos repoMetaData, history map[string]time.Duration) criticalPath {
+	deps := repoDependencies(repos)
+	median := medianDuration(history)
+	duration := func(repo string) time.Duration {
+		if d, ok := history[repo]; ok {
+			return d
+		}
+		return median
+	}
+	finish := make(map[string]time.Duration)
+	prev := make(map[string]string)
+	var parsed []string
+	for _, repo := range order {
+		before := parsed
+		if ds, ok := deps[repo]; ok {
+			before = nil
+			for _, dep := range ds {
+				before = append(before, dep.repo)
+			}
+			parsed = append(parsed, repo)
+		}
+		var start time.Duration
+		for _, dep := range before {
+			if f, ok := finish[dep]; ok && f > start {
+				start = f
+				prev[repo] = dep
+			}
+		}
+		finish[repo] = start + duration(repo)
+	}
+
+	var last string
+	for _, repo := range order {
+		if last == "" || finish[repo] > finish[last] {
+			last = repo
+		}
+	}
+	var path criticalPath
+	for repo := last; repo != ""; repo = prev[repo] {
+		path.Steps = append([]pathStep{{
+			Repo:       repo,
+			Duration:   duration(repo).Seconds(),
+			Cumulative: finish[repo].Seconds(),
+		}}, path.Steps...)
+	}
+	path.Total = finish[last].Seconds()
+	return path
+}
+
+// repoCounts summarizes what enumerating the source directory found.
+type repoCounts struct {
+	Total       int `json:"total"`
+	Parseable   int `json:"parseable"`
+	Unparseable int `json:"unparseable"`
+	// Salvaged repos are unparseable but had their packages
+	// extracted.
+	Salvaged    int `json:"salvaged"`
+	OptedOut    int `json:"opted_out"`
+	NoPackaging int `json:"no_packaging"`
+}
+
+func (c repoCounts) String() string {
+	return fmt.Sprintf("%d repos: %d parseable, %d unparseable "+
+		"(%d salvaged), %d opted out, %d without packaging",
+		c.Total, c.Parseable, c.Unparseable+c.Salvaged, c.Salvaged,
+		c.OptedOut, c.NoPackaging)
+}
+
+// countRepos counts the repos in from by what was found of their
+// packaging, without ordering them.
+func countRepos(from string, repos repoMetaData) (repoCounts, error) {
+	var c repoCounts
+	entries, err := sourceEntries(from)
+	if err != nil {
+		return c, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			c.Total++
+		}
+	}
+	c.Parseable = len(repos.ctrlFiles)
+	c.Unparseable = len(repos.unparseable)
+	c.Salvaged = len(repos.salvaged)
+	c.OptedOut = len(repos.optedOut)
+	c.NoPackaging = c.Total - c.Parseable - c.Unparseable -
+		c.Salvaged - c.OptedOut
+	return c, nil
+}
+
+// buildEstimate is the predicted wall clock time of building a set of
+// repos.
+type buildEstimate struct {
+	Repos int     `json:"repos"`
+	Jobs  int     `json:"jobs"`
+	Total float64 `json:"total"`
+	// Unknown repos have no build time and are assumed to take the
+	// median.
+	Unknown  []string     `json:"unknown,omitempty"`
+	Critical criticalPath `json:"critical_path"`
+}
+
+func (e buildEstimate) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Estimated build time for %d repos with %d jobs: %s\n",
+		e.Repos, e.Jobs, seconds(e.Total))
+	if len(e.Unknown) != 0 {
+		fmt.Fprintf(&b, "%d repos have no build times and are "+
+			"assumed to take the median: %s\n",
+			len(e.Unknown), e.Unknown)
+	}
+	b.WriteString(e.Critical.String())
+	return b.String()
+}
+
+// estimateBuild simulates the scheduler building the repos in
+// buildSet with the given jobs, weighting each repo by its build time
+// in history. As in buildRepos, parallel builds go level by level and
+// each build starts as soon as a job is free.
+func estimateBuild(buildSet []string, repos repoMetaData, history map[string]time.Duration, jobs int) buildEstimate {
+	est := buildEstimate{
+		Repos:    len(buildSet),
+		Jobs:     jobs,
+		Critical: findCriticalPath(buildSet, repos, history),
+	}
+	median := medianDuration(history)
+	schedule := [][]string{buildSet}
+	if jobs > 1 {
+		schedule = buildLevels(buildSet, repos)
+	}
+	var total time.Duration
+	for _, level := range schedule {
+		// when each job is next free, from the start of the level
+		free := make([]time.Duration, jobs)
+		var end time.Duration
+		for _, repo := range level {
+			d, ok := history[repo]
+			if !ok {
+				d = median
+				est.Unknown = append(est.Unknown, repo)
+			}
+			next := 0
+			for i := range free {
+				if free[i] < free[next] {
+					next = i
+				}
+			}
+			free[next] += d
+			if free[next] > end {
+				end = free[next]
+			}
+		}
+		total += end
+	}
+	est.Total = total.Seconds()
+	return est
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const timingsFile = "build-timings.csv"
+
+// readTimings loads the per repo build durations recorded by earlier
+// runs.
+func readTimings(path string) (map[string]time.Duration, error) {
+	out := make(map[string]time.Duration)
+	f, err := os.Open(path)
+	if err != nil {
+		return out, err
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return out, fmt.Errorf("%s: %s", path, err)
+	}
+	for i, rec := range records {
+		if i == 0 || len(rec) < 2 {
+			// header
+			continue
+		}
+		secs, err := strconv.ParseFloat(rec[1], 64)
+		if err != nil {
+			continue
+		}
+		out[rec[0]] = time.Duration(secs * float64(time.Second))
+	}
+	return out, nil
+}
+
+// writeTimings records the build durations of this run, keeping the
+// history of repos that were not built.
+func writeTimings(logDir string, results []repoResult) error {
+	path := filepath.Join(logDir, timingsFile)
+	timings, _ := readTimings(path)
+	for _, res := range results {
+		if res.Duration > 0 {
+			timings[res.Repo] = time.Duration(
+				res.Duration * float64(time.Second))
+		}
+	}
+	var repos []string
+	for repo := range timings {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"repo", "seconds"})
+	for _, repo := range repos {
+		w.Write([]string{repo, strconv.FormatFloat(
+			timings[repo].Seconds(), 'f', 1, 64)})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func medianDuration(ds map[string]time.Duration) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	var all []time.Duration
+	for _, d := range ds {
+		all = append(all, d)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	return all[len(all)/2]
+}
+
+// etaEstimator estimates the time left in a run from the durations of
+// previous builds. Repos without history are assumed to take the
+// median time.
+type etaEstimator struct {
+	history   map[string]time.Duration
+	median    time.Duration
+	remaining time.Duration
+	jobs      int
+}
+
+func newETA(history map[string]time.Duration, repos []string, jobs int) *etaEstimator {
+	e := &etaEstimator{
+		history: history,
+		median:  medianDuration(history),
+		jobs:    jobs,
+	}
+	for _, repo := range repos {
+		e.remaining += e.estimate(repo)
+	}
+	return e
+}
+
+func (e *etaEstimator) estimate(repo string) time.Duration {
+	if d, ok := e.history[repo]; ok {
+		return d
+	}
+	return e.median
+}
+
+func (e *etaEstimator) known() bool {
+	return len(e.history) != 0
+}
+
+func (e *etaEstimator) done(repo string) {
+	e.remaining -= e.estimate(repo)
+	if e.remaining < 0 {
+		e.remaining = 0
+	}
+}
+
+func (e *etaEstimator) String() string {
+	left := e.remaining / time.Duration(e.jobs)
+	if left < time.Minute {
+		return "less than a minute remaining"
+	}
+	mins := int(left.Round(time.Minute).Minutes())
+	if mins == 1 {
+		return "about 1 minute remaining"
+	}
+	return fmt.Sprintf("about %d minutes remaining", mins)
+}
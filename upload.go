@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	uploadUploaded = "uploaded"
+	uploadFailed   = "failed"
+)
+
+// uploadTimeout bounds how long a single upload request may take.
+const uploadTimeout = 10 * time.Minute
+
+// packageUploader pushes a repo's built packages to a repository
+// manager.
+type packageUploader interface {
+	Upload(ctx context.Context, repo string, files []string) error
+}
+
+// uploadConfig describes where packages are uploaded independent of
+// the backend that uploads them.
+type uploadConfig struct {
+	url       string
+	repo      string
+	dist      string
+	component string
+	// user and password authenticate the uploads when user is set
+	user     string
+	password string
+}
+
+var uploaders = map[string]func(uploadConfig) (packageUploader, error){
+	"aptly":       makeAptlyUploader,
+	"artifactory": makeArtifactoryUploader,
+}
+
+func makeUploader(name string, cfg uploadConfig) (packageUploader, error) {
+	mk, ok := uploaders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown upload backend %q", name)
+	}
+	if cfg.url == "" || cfg.repo == "" {
+		return nil, fmt.Errorf("-upload %s needs -upload-url and "+
+			"-upload-repo", name)
+	}
+	return mk(cfg)
+}
+
+// uploadConfigFromFlags returns the -upload-* settings, with the
+// credentials taken from $UPLOAD_USER and $UPLOAD_PASSWORD so they
+// don't end up in process listings.
+func uploadConfigFromFlags() uploadConfig {
+	return uploadConfig{
+		url:       strings.TrimSuffix(uploadServer, "/"),
+		repo:      uploadRepo,
+		dist:      uploadDist,
+		component: uploadComponent,
+		user:      os.Getenv("UPLOAD_USER"),
+		password:  os.Getenv("UPLOAD_PASSWORD"),
+	}
+}
+
+// uploadClient sends the requests of the HTTP based backends.
+type uploadClient struct {
+	cfg    uploadConfig
+	client *http.Client
+}
+
+func (c uploadClient) do(req *http.Request, v interface{}) error {
+	if c.cfg.user != "" {
+		req.SetBasicAuth(c.cfg.user, c.cfg.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL,
+			resp.Status, strings.TrimSpace(string(body)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// aptlyUploader adds packages to a local repo of an aptly API server.
+// The files are uploaded to a directory named after the repo and then
+// imported, which removes the directory. Publishing the aptly repo is
+// left to the server's own workflow.
+type aptlyUploader struct {
+	uploadClient
+}
+
+func makeAptlyUploader(cfg uploadConfig) (packageUploader, error) {
+	return aptlyUploader{uploadClient{
+		cfg:    cfg,
+		client: &http.Client{Timeout: uploadTimeout},
+	}}, nil
+}
+
+func (u aptlyUploader) Upload(ctx context.Context, repo string, files []string) error {
+	dir := "danos-bootstrap-" + repo
+	err := u.uploadFiles(ctx, dir, files)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		FailedFiles []string
+		Report      struct {
+			Warnings []string
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		fmt.Sprintf("%s/api/repos/%s/file/%s", u.cfg.url,
+			url.PathEscape(u.cfg.repo), url.PathEscape(dir)), nil)
+	if err != nil {
+		return err
+	}
+	err = u.do(req, &result)
+	if err != nil {
+		return err
+	}
+	if len(result.FailedFiles) != 0 {
+		return fmt.Errorf("aptly failed to add %s: %s",
+			strings.Join(result.FailedFiles, ", "),
+			strings.Join(result.Report.Warnings, "; "))
+	}
+	return nil
+}
+
+// uploadFiles posts files to an aptly upload directory as a multipart
+// form, streaming them rather than reading them into memory.
+func (u aptlyUploader) uploadFiles(ctx context.Context, dir string, files []string) error {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeMultipart(mw, files))
+	}()
+	defer pr.Close()
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		fmt.Sprintf("%s/api/files/%s", u.cfg.url, url.PathEscape(dir)),
+		pr)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return u.do(req, nil)
+}
+
+func writeMultipart(mw *multipart.Writer, files []string) error {
+	for _, file := range files {
+		part, err := mw.CreateFormFile("file", filepath.Base(file))
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(part, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// artifactoryUploader deploys packages to a Debian repository of an
+// Artifactory server, under pool/<repo>/, with the properties
+// Artifactory indexes them by.
+type artifactoryUploader struct {
+	uploadClient
+}
+
+func makeArtifactoryUploader(cfg uploadConfig) (packageUploader, error) {
+	return artifactoryUploader{uploadClient{
+		cfg:    cfg,
+		client: &http.Client{Timeout: uploadTimeout},
+	}}, nil
+}
+
+func (u artifactoryUploader) Upload(ctx context.Context, repo string, files []string) error {
+	for _, file := range files {
+		err := u.deploy(ctx, repo, file)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u artifactoryUploader) deploy(ctx context.Context, repo, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(file)
+	target := fmt.Sprintf("%s/%s;deb.distribution=%s;"+
+		"deb.component=%s;deb.architecture=%s", u.cfg.url,
+		path.Join(u.cfg.repo, "pool", repo, name), u.cfg.dist,
+		u.cfg.component, packageArch(name))
+	req, err := http.NewRequestWithContext(ctx, "PUT", target, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	return u.do(req, nil)
+}
+
+// packageArch returns the architecture in a name_version_arch.deb
+// package file name.
+func packageArch(name string) string {
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	fields := strings.Split(name, "_")
+	return fields[len(fields)-1]
+}
+
+// uploadResult records the upload of a repo's packages.
+type uploadResult struct {
+	Repo     string `json:"repo"`
+	Status   string `json:"status"`
+	Files    int    `json:"files"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+}
+
+// repoPackageFiles returns the package files in debDir built from the
+// repo in repoPath.
+func repoPackageFiles(debDir, repoPath string) ([]string, error) {
+	prefixes, err := artifactPrefixes(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, file := range append(globPackages(debDir, "*.deb"),
+		globPackages(debDir, "*.udeb")...) {
+		if isArtifact(filepath.Base(file), prefixes) {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// uploadPackages uploads the packages of each repo that built to the
+// -upload backend, retrying a repo's upload up to -upload-retries
+// times with a growing delay. A repo whose upload fails doesn't stop
+// the others being uploaded.
+func uploadPackages(ctx context.Context, up packageUploader, debDir, baseDir string, results []repoResult) []uploadResult {
+	var out []uploadResult
+	for _, res := range results {
+		switch res.Status {
+		case statusBuilt, statusPrebuilt:
+		default:
+			continue
+		}
+		result := uploadResult{Repo: res.Repo}
+		files, err := repoPackageFiles(debDir,
+			packagingDir(baseDir, res.Repo))
+		if err == nil && len(files) == 0 {
+			continue
+		}
+		result.Files = len(files)
+		delay := time.Second
+		for err == nil {
+			result.Attempts++
+			err = up.Upload(ctx, res.Repo, files)
+			if err == nil || result.Attempts > uploadRetries ||
+				ctx.Err() != nil {
+				break
+			}
+			fmt.Fprintf(os.Stderr, "warning: uploading %s failed, "+
+				"retrying in %s: %v\n", res.Repo, delay, err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+			delay *= 2
+			err = nil
+		}
+		result.Status = uploadUploaded
+		if err != nil {
+			result.Status = uploadFailed
+			result.Error = err.Error()
+		}
+		out = append(out, result)
+	}
+	return out
+}
+
+func uploadSummary(results []uploadResult) string {
+	var b strings.Builder
+	var files, failed int
+	for _, res := range results {
+		if res.Status == uploadFailed {
+			failed++
+			fmt.Fprintf(&b, "upload failed: %s: %s\n", res.Repo,
+				res.Error)
+			continue
+		}
+		files += res.Files
+	}
+	fmt.Fprintf(&b, "Uploaded %d packages from %d repos to %s, "+
+		"%d repos failed.", files, len(results)-failed, uploadBackend,
+		failed)
+	return b.String()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// repoFingerprint summarizes the state of a repo's files so changes
+// can be detected by polling.
+type repoFingerprint struct {
+	files   int
+	modTime time.Time
+}
+
+func fingerprintRepo(dir string) repoFingerprint {
+	var out repoFingerprint
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		out.files++
+		if info.ModTime().After(out.modTime) {
+			out.modTime = info.ModTime()
+		}
+		return nil
+	})
+	return out
+}
+
+func fingerprintRepos(srcDir string) map[string]repoFingerprint {
+	out := make(map[string]repoFingerprint)
+	entries, err := sourceEntries(srcDir)
+	if err != nil {
+		return out
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		out[entry.Name()] = fingerprintRepo(
+			sourceDir(srcDir, entry.Name()))
+	}
+	return out
+}
+
+func changedRepos(old, cur map[string]repoFingerprint) []string {
+	var out []string
+	for repo, fp := range cur {
+		if prev, ok := old[repo]; !ok || prev != fp {
+			out = append(out, repo)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// watchRepos polls the source directory and rebuilds the repos that
+// changed along with everything that depends on them, until stop is
+// cancelled.
+func watchRepos(ctx, stop context.Context) error {
+	out.Event("watching", srcDir,
+		fmt.Sprintf("Watching %s for changes", srcDir))
+	prev := fingerprintRepos(srcDir)
+	for {
+		select {
+		case <-stop.Done():
+			return nil
+		case <-time.After(watchInterval):
+		}
+		cur := fingerprintRepos(srcDir)
+		changed := changedRepos(prev, cur)
+		if len(changed) == 0 {
+			continue
+		}
+		out.Event("changed", changed,
+			fmt.Sprintf("Changed repos: %s", changed))
+
+		// The change may have altered the packaging so the
+		// graph must be recomputed.
+		repos, err := enumerateBuildableRepos(srcDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			prev = cur
+			continue
+		}
+		order := determineBuildOrder(repos)
+		buildSet := filterOrder(order, dependentClosure(changed, repos))
+		out.Event("rebuild", buildSet, fmt.Sprintf(
+			"Rebuilding %d repos: %s", len(buildSet), buildSet))
+		// Rebuilds of work in progress aren't uploaded.
+		err = runBuild(ctx, stop, buildSet, repos, nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+
+		// Builds may touch the source trees, only look for
+		// changes made after this rebuild.
+		prev = fingerprintRepos(srcDir)
+	}
+}